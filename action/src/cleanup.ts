@@ -2,15 +2,39 @@ import * as core from "@actions/core";
 import * as http from "@actions/http-client";
 
 async function cleanup() {
+  // revoke the access tokens
+  // https://docs.github.com/en/rest/reference/apps#revoke-an-installation-access-token
+  const apiUrl = process.env["GITHUB_API_URL"] || "https://api.github.com";
+  const client = new http.HttpClient("actions-github-app-token");
+  const tokens = new Set<string>();
+  const token = core.getState("token");
+  if (token) {
+    tokens.add(token);
+  }
+  for (const t of parseTokens(core.getState("tokens"))) {
+    tokens.add(t);
+  }
+  for (const t of tokens) {
+    await revoke(client, apiUrl, t);
+  }
+}
+
+// parseTokens parses the tokens for the installations saved by the main step.
+function parseTokens(s: string): string[] {
+  if (!s) {
+    return [];
+  }
+  try {
+    const tokens = JSON.parse(s);
+    return Array.isArray(tokens) ? tokens.filter((t) => typeof t === "string" && t) : [];
+  } catch (error) {
+    core.info(`[warning] ${error}`);
+    return [];
+  }
+}
+
+async function revoke(client: http.HttpClient, apiUrl: string, token: string) {
   try {
-    // revoke the access token
-    // https://docs.github.com/en/rest/reference/apps#revoke-an-installation-access-token
-    const apiUrl = process.env["GITHUB_API_URL"] || "https://api.github.com";
-    const client = new http.HttpClient("actions-github-app-token");
-    const token = core.getState("token");
-    if (!token) {
-      return;
-    }
     const resp = await client.del(`${apiUrl}/installation/token`, {
       Authorization: `token ${token}`,
       Accept: "application/vnd.github+json",
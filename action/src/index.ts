@@ -75,6 +75,14 @@ interface GetTokenResult {
   github_token: string;
   message?: string;
   warning?: string;
+  tokens?: InstallationToken[];
+}
+
+interface InstallationToken {
+  github_token: string;
+  installation_id?: number;
+  account?: string;
+  repositories?: string[];
 }
 
 interface GetTokenError {
@@ -119,6 +127,16 @@ export async function assumeRole(params: GetTokenParams) {
   core.setSecret(resp.github_token);
   core.setOutput("token", resp.github_token);
   core.saveState("token", resp.github_token);
+
+  // the repositories in the other installations need their own tokens.
+  const tokens = resp.tokens || [];
+  if (tokens.length > 0) {
+    for (const t of tokens) {
+      core.setSecret(t.github_token);
+    }
+    core.setOutput("tokens", JSON.stringify(tokens));
+    core.saveState("tokens", JSON.stringify(tokens.map((t) => t.github_token)));
+  }
 }
 
 function isIdTokenAvailable(): boolean {
@@ -0,0 +1,262 @@
+package githubapptoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+)
+
+// appConfig is the configuration of a GitHub App behind the API.
+// GITHUB_APPS has the list of them:
+//
+//	# the read-only app.
+//	- app_id: 123456
+//	  kms_key_id: alias/github-app-read-only
+//
+//	# the release app.
+//	- app_id: 234567
+//	  kms_key_id: alias/github-app-release
+//	  api_url: https://api.github.com
+//
+//	# the app that also accepts the unique issuer of an enterprise.
+//	- app_id: 345678
+//	  kms_key_id: alias/github-app-admin
+//	  trusted_issuers:
+//	    - issuer: https://token.actions.githubusercontent.com/octocorp
+//	      owners: [octocorp, octocorp-sandbox]
+//
+//	# the app on GitHub Enterprise Server.
+//	- app_id: 12
+//	  kms_key_id: alias/github-app-ghes
+//	  api_url: https://ghes.example.com/api/v3
+//
+//	# the app on GitHub Enterprise Server in an isolated network.
+//	- app_id: 34
+//	  kms_key_id: alias/github-app-isolated-ghes
+//	  api_url: https://isolated-ghes.example.com/api/v3
+//	  jwks_parameter: /github-app-token/isolated-ghes-jwks
+//
+// The template allows the function to sign only with the KMS aliases that start with KmsKeyId and a hyphen,
+// such as alias/github-app-release for the default alias/github-app.
+// The requests are routed by the audience and api_url.
+type appConfig struct {
+	// AppID is the id of the app.
+	AppID uint64 `yaml:"app_id"`
+
+	// KMSKeyID is the id of the KMS key that has the private key of the app.
+	KMSKeyID string `yaml:"kms_key_id"`
+
+	// APIURL is the url of GitHub API. The default is GITHUB_API_URL.
+	APIURL string `yaml:"api_url"`
+
+	// Issuer is the issuer of the OIDC tokens.
+	// The default is the issuer of APIURL, https://HOSTNAME/_services/token for GitHub Enterprise Server.
+	Issuer string `yaml:"issuer"`
+
+	// TrustedIssuers are the other issuers of the OIDC tokens that the app accepts.
+	TrustedIssuers []*trustedIssuerConfig `yaml:"trusted_issuers"`
+
+	// JWKSFile and JWKSParameter are the static JWK Set of Issuer,
+	// in a local file or a Systems Manager parameter, for the issuers that the API can't reach.
+	// The default is discovering the JWK Set from Issuer.
+	JWKSFile      string `yaml:"jwks_file"`
+	JWKSParameter string `yaml:"jwks_parameter"`
+}
+
+// trustedIssuerConfig is an issuer of the OIDC tokens other than the default one,
+// such as the unique issuer of an enterprise, https://token.actions.githubusercontent.com/<enterprise-slug>.
+type trustedIssuerConfig struct {
+	// Issuer is the url of the issuer.
+	Issuer string `yaml:"issuer"`
+
+	// Owners are the owners of the repositories that the issuer can issue the tokens for.
+	// Empty means any owner.
+	Owners []string `yaml:"owners"`
+
+	// JWKSFile and JWKSParameter are the static JWK Set of the issuer, same as appConfig.
+	JWKSFile      string `yaml:"jwks_file"`
+	JWKSParameter string `yaml:"jwks_parameter"`
+}
+
+// parseTrustedIssuers parses the list of the trusted issuers in GITHUB_OIDC_TRUSTED_ISSUERS.
+func parseTrustedIssuers(data []byte) ([]*trustedIssuerConfig, error) {
+	var configs []*trustedIssuerConfig
+	if err := yaml.UnmarshalWithOptions(data, &configs, yaml.Strict()); err != nil {
+		return nil, err
+	}
+	if err := validateTrustedIssuers(configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+func validateTrustedIssuers(configs []*trustedIssuerConfig) error {
+	for i, c := range configs {
+		u, err := url.Parse(c.Issuer)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("trusted_issuers[%d]: invalid issuer: %q", i, c.Issuer)
+		}
+		if c.JWKSFile != "" && c.JWKSParameter != "" {
+			return fmt.Errorf("trusted_issuers[%d]: only one of jwks_file and jwks_parameter can be set", i)
+		}
+	}
+	return nil
+}
+
+// parseAppConfigs parses the list of the app configurations.
+func parseAppConfigs(data []byte) ([]*appConfig, error) {
+	var configs []*appConfig
+	if err := yaml.UnmarshalWithOptions(data, &configs, yaml.Strict()); err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		return nil, errors.New("no apps are configured")
+	}
+	// the ids of the apps are unique only in each host.
+	type key struct {
+		apiURL string
+		appID  uint64
+	}
+	seen := make(map[key]struct{}, len(configs))
+	for i, c := range configs {
+		if c.AppID == 0 {
+			return nil, fmt.Errorf("apps[%d]: app_id is required", i)
+		}
+		if c.KMSKeyID == "" {
+			return nil, fmt.Errorf("apps[%d]: kms_key_id is required", i)
+		}
+		if c.JWKSFile != "" && c.JWKSParameter != "" {
+			return nil, fmt.Errorf("apps[%d]: only one of jwks_file and jwks_parameter can be set", i)
+		}
+		if err := validateTrustedIssuers(c.TrustedIssuers); err != nil {
+			return nil, fmt.Errorf("apps[%d]: %w", i, err)
+		}
+		apiURL, err := github.CanonicalAPIURL(c.APIURL)
+		if err != nil {
+			return nil, fmt.Errorf("apps[%d]: invalid api_url: %w", i, err)
+		}
+		k := key{
+			apiURL: apiURL,
+			appID:  c.AppID,
+		}
+		if _, ok := seen[k]; ok {
+			return nil, fmt.Errorf("apps[%d]: duplicated app_id %d", i, c.AppID)
+		}
+		seen[k] = struct{}{}
+	}
+	return configs, nil
+}
+
+// newAppHandler creates the handler for an app.
+// It shares the operator policy and the token store with h.
+func (h *Handler) newAppHandler(ctx context.Context, c *appConfig, httpClient github.Doer, kmssvc github.KMSService, ssmsvc ssmService) (*Handler, error) {
+	client, err := github.NewClient(httpClient, c.AppID, kmssvc, c.KMSKeyID)
+	if err != nil {
+		return nil, err
+	}
+	client.SetJWKSObserver(observeJWKS)
+	issuer := c.Issuer
+	if c.APIURL != "" {
+		if err := client.SetAPIURL(c.APIURL); err != nil {
+			return nil, fmt.Errorf("invalid api_url of the app %d: %w", c.AppID, err)
+		}
+		if issuer == "" {
+			issuer, err = github.DefaultOIDCIssuer(c.APIURL)
+			if err != nil {
+				return nil, fmt.Errorf("invalid api_url of the app %d: %w", c.AppID, err)
+			}
+		}
+	}
+	if issuer != "" {
+		if err := client.SetOIDCIssuer(issuer); err != nil {
+			return nil, fmt.Errorf("invalid issuer of the app %d: %w", c.AppID, err)
+		}
+	}
+	loader, err := newJWKSLoader(c.JWKSFile, c.JWKSParameter, ssmsvc)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWK Set of the app %d: %w", c.AppID, err)
+	}
+	if loader != nil {
+		if err := client.SetJWKSLoader(client.OIDCIssuer(), loader); err != nil {
+			return nil, fmt.Errorf("invalid JWK Set of the app %d: %w", c.AppID, err)
+		}
+	}
+	for _, t := range c.TrustedIssuers {
+		if err := client.AddTrustedIssuer(t.Issuer, t.Owners); err != nil {
+			return nil, fmt.Errorf("invalid trusted issuer of the app %d: %w", c.AppID, err)
+		}
+		loader, err := newJWKSLoader(t.JWKSFile, t.JWKSParameter, ssmsvc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWK Set of the trusted issuer %s: %w", t.Issuer, err)
+		}
+		if loader != nil {
+			if err := client.SetJWKSLoader(t.Issuer, loader); err != nil {
+				return nil, fmt.Errorf("invalid JWK Set of the trusted issuer %s: %w", t.Issuer, err)
+			}
+		}
+	}
+	app, err := client.GetApp(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the information of the app %d, check your configure: %w", c.AppID, err)
+	}
+	return &Handler{
+		github:  client,
+		app:     app,
+		appID:   c.AppID,
+		policy:  h.policy,
+		tokens:  h.tokens,
+		replay:  h.replay,
+		maxUses: h.maxUses,
+		noreply: client.NoReplyDomain(),
+	}, nil
+}
+
+// selectApp returns the handler for the app that the OIDC token is issued for, on the GitHub API at apiURL.
+// It only peeks the audience of the token; the handler of the app validates the token.
+func (h *Handler) selectApp(token, apiURL string) (*Handler, error) {
+	if len(h.apps) == 0 {
+		return h, nil
+	}
+	claims, err := github.PeekClaims(token)
+	if err != nil {
+		return nil, &validationError{
+			message: fmt.Sprintf("invalid JSON Web Token: %s", err.Error()),
+		}
+	}
+	aud := claims.Audience
+
+	found := false
+	for _, a := range aud {
+		v, ok := strings.CutPrefix(a, audiencePrefix)
+		if !ok {
+			continue
+		}
+		appID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		for _, app := range h.apps {
+			if app.appID != appID {
+				continue
+			}
+			found = true
+			if app.github.ValidateAPIURL(apiURL) == nil {
+				return app, nil
+			}
+		}
+	}
+	if found {
+		return nil, &validationError{
+			message: fmt.Sprintf("the api server %s is not configured for the app in the credential provider", apiURL),
+		}
+	}
+	return nil, &validationError{
+		message: fmt.Sprintf("invalid audience: %v", aud),
+	}
+}
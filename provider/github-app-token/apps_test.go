@@ -0,0 +1,223 @@
+package githubapptoken
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+	"github.com/shogo82148/goat/jwt"
+)
+
+func TestParseAppConfigs(t *testing.T) {
+	configs, err := parseAppConfigs([]byte("- app_id: 123456\n" +
+		"  kms_key_id: alias/read-only-app\n" +
+		"  trusted_issuers:\n" +
+		"    - issuer: https://token.actions.githubusercontent.com/octocorp\n" +
+		"      owners: [octocorp]\n" +
+		"- app_id: 234567\n" +
+		"  kms_key_id: alias/release-app\n" +
+		"  api_url: https://api.github.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*appConfig{
+		{
+			AppID:    123456,
+			KMSKeyID: "alias/read-only-app",
+			TrustedIssuers: []*trustedIssuerConfig{
+				{Issuer: "https://token.actions.githubusercontent.com/octocorp", Owners: []string{"octocorp"}},
+			},
+		},
+		{AppID: 234567, KMSKeyID: "alias/release-app", APIURL: "https://api.github.com"},
+	}
+	if !reflect.DeepEqual(configs, want) {
+		t.Errorf("unexpected configs: want %#v, got %#v", want, configs)
+	}
+}
+
+func TestParseAppConfigs_Invalid(t *testing.T) {
+	cases := []struct {
+		content string
+		err     string
+	}{
+		{
+			content: "[]\n",
+			err:     "no apps are configured",
+		},
+		{
+			content: "- app_id: 123456\n  kms_key: alias/app\n",
+			err:     `unknown field "kms_key"`,
+		},
+		{
+			content: "- kms_key_id: alias/app\n",
+			err:     "apps[0]: app_id is required",
+		},
+		{
+			content: "- app_id: 123456\n",
+			err:     "apps[0]: kms_key_id is required",
+		},
+		{
+			content: "- app_id: 123456\n  kms_key_id: alias/app\n- app_id: 123456\n  kms_key_id: alias/app\n",
+			err:     "apps[1]: duplicated app_id 123456",
+		},
+		{
+			content: "- app_id: 123456\n  kms_key_id: alias/app\n  trusted_issuers:\n    - issuer: token.actions.githubusercontent.com/octocorp\n",
+			err:     `apps[0]: trusted_issuers[0]: invalid issuer: "token.actions.githubusercontent.com/octocorp"`,
+		},
+		{
+			content: "- app_id: 12\n  kms_key_id: alias/app\n  api_url: https://ghes.example.com/api/v3\n" +
+				"- app_id: 12\n  kms_key_id: alias/app\n  api_url: https://GHES.example.com/api/v3/\n",
+			err: "apps[1]: duplicated app_id 12",
+		},
+		{
+			content: "- app_id: 123456\n  kms_key_id: alias/app\n" +
+				"- app_id: 123456\n  kms_key_id: alias/app-x\n  api_url: https://API.github.com/\n",
+			err: "apps[1]: duplicated app_id 123456",
+		},
+		{
+			content: "- app_id: 123456\n  kms_key_id: alias/app\n  api_url: \"https://api.github.com/%zz\"\n",
+			err:     "apps[0]: invalid api_url",
+		},
+		{
+			content: "- app_id: 123456\n  kms_key_id: alias/app\n  jwks_file: jwks.json\n  jwks_parameter: /jwks\n",
+			err:     "apps[0]: only one of jwks_file and jwks_parameter can be set",
+		},
+		{
+			content: "- app_id: 123456\n  kms_key_id: alias/app\n  trusted_issuers:\n" +
+				"    - issuer: https://token.actions.githubusercontent.com/octocorp\n      jwks_file: jwks.json\n      jwks_parameter: /jwks\n",
+			err: "apps[0]: trusted_issuers[0]: only one of jwks_file and jwks_parameter can be set",
+		},
+	}
+	for i, c := range cases {
+		_, err := parseAppConfigs([]byte(c.content))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%d: want error %q, got %v", i, c.err, err)
+		}
+	}
+}
+
+// fakeIDToken returns a token that has only the payload, for github.PeekClaims.
+func fakeIDToken(payload string) string {
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".signature"
+}
+
+func TestHandle_SelectApp(t *testing.T) {
+	newApp := func(appID uint64, apiURL string) *Handler {
+		return &Handler{
+			github: &githubClientMock{
+				ValidateAPIURLFunc: func(url string) error {
+					if url != apiURL {
+						return errors.New("your api server is not verified by the credential provider")
+					}
+					return nil
+				},
+				ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+					claims, err := github.PeekClaims(idToken)
+					if err != nil {
+						return nil, err
+					}
+					aud := claims.Audience
+					return &github.ActionsIDToken{
+						Claims: &jwt.Claims{
+							Audience: aud,
+						},
+						Repository:        "shogo82148/actions-github-app-token",
+						RepositoryID:      "398574950",
+						RepositoryOwnerID: "1157344",
+					}, nil
+				},
+				GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+					return &github.GetRepoResponse{
+						ID:     398574950,
+						NodeID: "R_kgDOF8HFZg",
+					}, nil
+				},
+				GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+					return nil, &github.UnexpectedStatusCodeError{
+						StatusCode: http.StatusNotFound,
+					}
+				},
+				GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+					return &github.GetReposInstallationResponse{
+						ID: appID,
+					}, nil
+				},
+				CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+					return &github.CreateAppAccessTokenResponse{
+						Token: fmt.Sprintf("ghs_app%d@%s", appID, apiURL),
+					}, nil
+				},
+				RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+					return nil
+				},
+			},
+			appID: appID,
+		}
+	}
+	h := &Handler{
+		apps: []*Handler{
+			newApp(123456, "https://api.github.com"),
+			newApp(234567, "https://api.github.com"),
+
+			// the ids of the apps are unique only in each host.
+			newApp(123456, "https://ghes.example.com/api/v3"),
+		},
+	}
+
+	cases := []struct {
+		aud    string
+		apiURL string
+		want   string
+	}{
+		{
+			aud:    "https://github-app.shogo82148.com/234567",
+			apiURL: "https://api.github.com",
+			want:   "ghs_app234567@https://api.github.com",
+		},
+		{
+			aud:    "https://github-app.shogo82148.com/123456",
+			apiURL: "https://api.github.com",
+			want:   "ghs_app123456@https://api.github.com",
+		},
+		{
+			aud:    "https://github-app.shogo82148.com/123456",
+			apiURL: "https://ghes.example.com/api/v3",
+			want:   "ghs_app123456@https://ghes.example.com/api/v3",
+		},
+	}
+	for _, c := range cases {
+		resp, err := h.handle(context.Background(), fakeIDToken(`{"aud":"`+c.aud+`"}`), &requestBody{
+			APIURL: c.apiURL,
+		})
+		if err != nil {
+			t.Errorf("%s on %s: unexpected error: %v", c.aud, c.apiURL, err)
+			continue
+		}
+		if resp.GitHubToken != c.want {
+			t.Errorf("%s on %s: want %q, got %q", c.aud, c.apiURL, c.want, resp.GitHubToken)
+		}
+	}
+
+	// the app is not behind the API.
+	_, err := h.handle(context.Background(), fakeIDToken(`{"aud":"https://github-app.shogo82148.com/345678"}`), &requestBody{
+		APIURL: "https://api.github.com",
+	})
+	var validation *validationError
+	if !errors.As(err, &validation) || validation.message != "invalid audience: [https://github-app.shogo82148.com/345678]" {
+		t.Errorf("want invalid audience, got %v", err)
+	}
+
+	// the app is not on the host.
+	_, err = h.handle(context.Background(), fakeIDToken(`{"aud":"https://github-app.shogo82148.com/234567"}`), &requestBody{
+		APIURL: "https://ghes.example.com/api/v3",
+	})
+	if !errors.As(err, &validation) || !strings.Contains(validation.message, "is not configured") {
+		t.Errorf("want not configured, got %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+// Command policy-check checks the policy files of the GitHub Token Vending API,
+// .github/actions.yaml and .github/org-actions.yaml, before they are merged.
+//
+//	policy-check .github/actions.yaml
+//
+// With -claims, it also simulates the decision for the claims of the OIDC token:
+//
+//	policy-check -claims claims.json -request request.json -target owner/repo .github/actions.yaml
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	githubapptoken "github.com/shogo82148/actions-github-app-token/provider/github-app-token"
+)
+
+func main() {
+	var claims, request, target, nodeID string
+	flag.StringVar(&claims, "claims", "", "simulate the decision for the claims of the OIDC token in the JSON `file`")
+	flag.StringVar(&request, "request", "", "the request body in the JSON `file` for the simulation")
+	flag.StringVar(&target, "target", "", "the full name of the target `repository` for the simulation. the default is the repository in the claims")
+	flag.StringVar(&nodeID, "node-id", "", "the global node `id` of the repository in the claims for the simulation")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] FILE...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	status := 0
+	sim := &githubapptoken.PolicySimulation{
+		Target: target,
+		NodeID: nodeID,
+	}
+	for _, name := range flag.Args() {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+			continue
+		}
+		if err := githubapptoken.LintPolicy(name, data); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			status = 1
+			continue
+		}
+		if githubapptoken.IsOrgPolicy(name) {
+			sim.OrgPolicy = data
+		} else {
+			sim.Policy = data
+		}
+	}
+	if status != 0 || claims == "" {
+		os.Exit(status)
+	}
+
+	if err := simulate(sim, claims, request); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func simulate(sim *githubapptoken.PolicySimulation, claims, request string) error {
+	var err error
+	sim.Claims, err = os.ReadFile(claims)
+	if err != nil {
+		return err
+	}
+	if request != "" {
+		sim.Request, err = os.ReadFile(request)
+		if err != nil {
+			return err
+		}
+	}
+
+	decision, err := githubapptoken.SimulatePolicy(context.Background(), sim)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(decision); err != nil {
+		return err
+	}
+	if !decision.Allowed {
+		return fmt.Errorf("permission denied for %s: %s", decision.Repository, decision.Error)
+	}
+	return nil
+}
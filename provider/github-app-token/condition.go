@@ -0,0 +1,156 @@
+package githubapptoken
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+)
+
+// conditionCostLimit limits the cost of evaluating a condition,
+// so that a condition can't consume the resources of the provider.
+const conditionCostLimit = 10000
+
+// conditionEnv returns the environment of the conditions.
+// The conditions can use the following variables:
+//
+//   - claims: the claims of the OIDC token, such as claims.ref and claims.actor.
+//   - permissions: the requested permissions, such as permissions.contents.
+//   - repository: the repository that the token will access; id, owner, name, and full_name.
+var conditionEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("claims", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("permissions", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("repository", cel.MapType(cel.StringType, cel.DynType)),
+	)
+})
+
+// condition is a compiled expression in the Common Expression Language (CEL).
+// https://github.com/google/cel-spec
+type condition struct {
+	expr    string
+	program cel.Program
+}
+
+// compileCondition compiles the expression.
+func compileCondition(expr string) (*condition, error) {
+	env, err := conditionEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, iss := env.Compile(expr)
+	if err := iss.Err(); err != nil {
+		return nil, err
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("the condition must be bool, but got %s", ast.OutputType())
+	}
+	program, err := env.Program(
+		ast,
+		cel.CostLimit(conditionCostLimit),
+		cel.InterruptCheckFrequency(100),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &condition{
+		expr:    expr,
+		program: program,
+	}, nil
+}
+
+// eval evaluates the condition against the request.
+func (c *condition) eval(ctx context.Context, req *policyRequest) (bool, error) {
+	out, _, err := c.program.ContextEval(ctx, req.activation())
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate the condition %q: %w", c.expr, err)
+	}
+	ret, ok := out.Value().(bool)
+	if !ok {
+		return false, errors.New("the condition must be bool")
+	}
+	return ret, nil
+}
+
+// activation returns the variables of the conditions.
+func (req *policyRequest) activation() map[string]any {
+	permissions := make(map[string]string, len(req.Permissions))
+	for name, level := range req.Permissions {
+		permissions[name] = level
+	}
+
+	repository := map[string]any{}
+	if t := req.Target; t != nil {
+		repository["id"] = int64(t.ID)
+		repository["owner"] = t.Owner
+		repository["name"] = t.Name
+		repository["full_name"] = t.Owner + "/" + t.Name
+	}
+
+	return map[string]any{
+		"claims":      claimsMap(req.From.Claims),
+		"permissions": permissions,
+		"repository":  repository,
+	}
+}
+
+// claimsMap converts the claims of the OIDC token into a map.
+func claimsMap(id *github.ActionsIDToken) map[string]any {
+	ret := map[string]any{}
+	if id == nil {
+		return ret
+	}
+
+	// the custom claims that are decoded.
+	v := reflect.ValueOf(id).Elem()
+	t := v.Type()
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("jwt"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		ret[name] = v.Field(i).Interface()
+	}
+
+	// the raw claims, including the registered claims.
+	if id.Claims != nil {
+		for name, value := range id.Claims.Raw {
+			ret[name] = normalizeClaim(value)
+		}
+	}
+	return ret
+}
+
+// normalizeClaim converts the JSON value into the types that CEL accepts.
+func normalizeClaim(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case []any:
+		ret := make([]any, len(v))
+		for i, item := range v {
+			ret[i] = normalizeClaim(item)
+		}
+		return ret
+	case map[string]any:
+		ret := make(map[string]any, len(v))
+		for key, item := range v {
+			ret[key] = normalizeClaim(item)
+		}
+		return ret
+	default:
+		return v
+	}
+}
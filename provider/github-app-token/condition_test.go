@@ -0,0 +1,152 @@
+package githubapptoken
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+	"github.com/shogo82148/goat/jwt"
+)
+
+func TestCompileCondition_Invalid(t *testing.T) {
+	cases := []string{
+		// syntax error
+		`claims.actor ==`,
+
+		// unknown variable
+		`foo == "bar"`,
+
+		// not bool
+		`claims.actor`,
+	}
+	for _, c := range cases {
+		if _, err := compileCondition(c); err == nil {
+			t.Errorf("%q: want error, but not", c)
+		}
+	}
+}
+
+func TestCondition_Eval(t *testing.T) {
+	req := &policyRequest{
+		From: &callerRepository{
+			Claims: &github.ActionsIDToken{
+				Claims: &jwt.Claims{
+					Raw: map[string]any{
+						"actor":  "shogo82148",
+						"ref":    "refs/tags/v1.0.0",
+						"run_id": "1234567890",
+						"iat":    json.Number("1700000000"),
+					},
+				},
+				Actor: "shogo82148",
+				Ref:   "refs/tags/v1.0.0",
+			},
+		},
+		Target: &targetRepository{
+			ID:    398574950,
+			Owner: "shogo82148",
+			Name:  "actions-github-app-token",
+		},
+		Permissions: permissionSet{
+			"contents": "write",
+		},
+	}
+
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{`claims.actor != "dependabot[bot]" && claims.ref.startsWith("refs/tags/v")`, true},
+		{`claims.actor == "dependabot[bot]"`, false},
+		{`claims.iat > 1600000000`, true},
+		{`claims.environment == ""`, true},
+		{`!("administration" in permissions)`, true},
+		{`permissions.contents == "write"`, true},
+		{`repository.full_name == "shogo82148/actions-github-app-token"`, true},
+		{`repository.id == 398574950`, true},
+	}
+	for _, c := range cases {
+		cond, err := compileCondition(c.expr)
+		if err != nil {
+			t.Errorf("%q: %v", c.expr, err)
+			continue
+		}
+		got, err := cond.eval(context.Background(), req)
+		if err != nil {
+			t.Errorf("%q: %v", c.expr, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q: want %t, got %t", c.expr, c.want, got)
+		}
+	}
+}
+
+func TestParsePolicy_InvalidCondition(t *testing.T) {
+	_, err := parsePolicy([]byte("repositories:\n  - repository: R_kgDOF8HFZg\n    condition: claims.actor ==\n"))
+	var validation *validationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("want *validationError, but got %T", err)
+	}
+}
+
+func TestPolicyConfig_GrantWithCondition(t *testing.T) {
+	content := `
+repositories:
+  - repository: R_kgDOF8HFZg
+    condition: claims.actor != "dependabot[bot]"
+  - repository: R_kgDOF8HFZg
+    condition: claims.unknown_claim == "foo"
+`
+	config, err := parsePolicy([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err := parseOrgPolicy([]byte("deny:\n  - condition: claims.unknown_claim == \"foo\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		actor       string
+		org         *orgPolicyConfig
+		wantAllowed bool
+	}{
+		{
+			name:        "allowed actor",
+			actor:       "shogo82148",
+			wantAllowed: true,
+		},
+		{
+			name:        "denied actor",
+			actor:       "dependabot[bot]",
+			wantAllowed: false,
+		},
+		{
+			name:        "failed deny condition",
+			actor:       "shogo82148",
+			org:         org,
+			wantAllowed: false,
+		},
+	}
+	for _, c := range cases {
+		req := &policyRequest{
+			From: &callerRepository{
+				NodeID: "R_kgDOF8HFZg",
+				Claims: &github.ActionsIDToken{
+					Actor: c.actor,
+				},
+			},
+		}
+		_, allowed, err := evaluatePolicies(context.Background(), c.org, config, req, &resolverMock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != c.wantAllowed {
+			t.Errorf("%s: unexpected allowed: want %t, got %t", c.name, c.wantAllowed, allowed)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package githubapptoken
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+	"golang.org/x/sync/errgroup"
+)
+
+// dryRunResult is the explanation of the decision in the dry run.
+type dryRunResult struct {
+	// Allowed reports whether the token would be issued.
+	Allowed bool `json:"allowed"`
+
+	// Permissions is the permissions that the token would have.
+	// If the repositories span several installations of the app, it is for the installation of the caller.
+	// It is omitted if the token would have all permissions the app has.
+	Permissions permissionSet `json:"permissions,omitempty"`
+
+	// Error is the reason why the token would not be issued.
+	Error string `json:"error,omitempty"`
+
+	// Self is the decision for the repository that requests the token.
+	// With the organization scope, it is the decision for the owner.
+	Self *repositoryDecision `json:"self"`
+
+	// Repositories are the decisions for the other repositories in the request.
+	Repositories []*repositoryDecision `json:"repositories,omitempty"`
+}
+
+// repositoryDecision is the decision of the policies for a repository.
+type repositoryDecision struct {
+	// Repository is the repository in the request.
+	Repository string `json:"repository"`
+
+	// Allowed reports whether the access to the repository is allowed.
+	Allowed bool `json:"allowed"`
+
+	// Permissions is the maximum permissions for the repository.
+	// It is omitted if the policies don't limit the permissions.
+	Permissions permissionSet `json:"permissions,omitempty"`
+
+	// Error is the reason why the access is not allowed.
+	Error string `json:"error,omitempty"`
+
+	// Rules are the rules that are evaluated, in order.
+	Rules []*ruleDecision `json:"rules"`
+}
+
+// ruleDecision is the result of a rule in the policies.
+type ruleDecision struct {
+	// Policy is the location of the policy file, such as "owner/repo/.github/actions.yaml".
+	Policy string `json:"policy"`
+
+	// Rule is the position of the rule in the policy file, such as "repositories[0]".
+	Rule string `json:"rule"`
+
+	// Matched reports whether the rule matches the request.
+	Matched bool `json:"matched"`
+
+	// Reason describes why the rule doesn't match.
+	Reason string `json:"reason,omitempty"`
+
+	// Permissions is the maximum permissions of the rule.
+	Permissions permissionSet `json:"permissions,omitempty"`
+}
+
+// record records the result of a rule.
+// It does nothing if d is nil, so that the evaluation outside of the dry run doesn't need to care.
+func (d *repositoryDecision) record(policy, rule string, matched bool, reason string, permissions permissionSet) {
+	if d == nil {
+		return
+	}
+	d.Rules = append(d.Rules, &ruleDecision{
+		Policy:      policy,
+		Rule:        rule,
+		Matched:     matched,
+		Reason:      reason,
+		Permissions: permissions,
+	})
+}
+
+// finish records the final decision for the repository.
+func (d *repositoryDecision) finish(permissions permissionSet, err error) {
+	if err != nil {
+		d.Error = err.Error()
+		return
+	}
+	d.Allowed = true
+	d.Permissions = permissions
+}
+
+// dryRun evaluates the policies as getRepositoryIDs does, and explains the decision without issuing the token.
+// Unlike getRepositoryIDs, it evaluates all repositories even if some of them are denied.
+func (h *Handler) dryRun(ctx context.Context, inst *github.GetReposInstallationResponse, id *github.ActionsIDToken, repoID uint64, owner, repo string, req *requestBody) (*dryRunResult, error) {
+	tokens := newPolicyTokens(h)
+	defer tokens.revoke(ctx)
+	token, err := tokens.get(ctx, inst.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	preq, err := h.newPolicyRequest(ctx, token, id, repoID, owner, repo, req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &dryRunResult{}
+	self := *preq
+	self.explain = &repositoryDecision{
+		Repository: owner + "/" + repo,
+		Rules:      []*ruleDecision{},
+	}
+	var ceiling permissionSet
+	if req.Scope == scopeOrganization {
+		self.explain.Repository = owner
+		ceiling, err = h.checkOrganizationPermission(ctx, token, inst, owner, repo, &self)
+	} else {
+		ceiling, err = h.checkSelfPermission(ctx, token, owner, repo, &self)
+	}
+	self.explain.finish(ceiling, err)
+	result.Self = self.explain
+
+	resolver := newGitHubResolver(h.github, token)
+	orgs := newOrgPolicyCache()
+	grants := make([]*grant, len(req.Repositories))
+	var g errgroup.Group
+	for i, ref := range req.Repositories {
+		if ref.String() == "" {
+			continue
+		}
+		target := *preq
+		target.explain = &repositoryDecision{
+			Repository: ref.String(),
+			Rules:      []*ruleDecision{},
+		}
+		result.Repositories = append(result.Repositories, target.explain)
+		g.Go(func() error {
+			grant, err := h.checkPermission(ctx, tokens, inst, owner, ref, &target, resolver, orgs)
+			if err != nil {
+				slog.DebugContext(ctx, "permission denied", errAttr(err), slog.String("repository", ref.String()))
+				target.explain.finish(nil, err)
+				return nil
+			}
+			target.explain.finish(grant.Permissions, nil)
+			grants[i] = grant
+			return nil
+		})
+	}
+	g.Wait()
+
+	for _, d := range append([]*repositoryDecision{result.Self}, result.Repositories...) {
+		if !d.Allowed {
+			result.Error = "permission denied for " + d.Repository
+			return result, nil
+		}
+	}
+
+	// the permissions of the tokens for the other installations are checked in the same way,
+	// but only the token for the installation of the caller is reported.
+	groups := groupGrants(&installationGrant{
+		Installation: inst,
+		Owner:        owner,
+		Permissions:  ceiling,
+	}, grants)
+	for i, group := range groups {
+		ceiling, err := h.operatorCeiling(group.Owner, group.Permissions, group.Installation)
+		if err != nil {
+			return nil, err
+		}
+		permissions, err := clampPermissions(ceiling, permissionSet(group.Installation.Permissions), req.Permissions)
+		if err != nil {
+			var forbidden *forbiddenError
+			if errors.As(err, &forbidden) {
+				err = forbidden.err
+			}
+			result.Error = err.Error()
+			return result, nil
+		}
+		if i == 0 {
+			result.Permissions = permissions.toPermissionSet()
+		}
+	}
+	result.Allowed = true
+	return result, nil
+}
@@ -12,6 +12,7 @@ type githubClientDummy struct{}
 
 func (c *githubClientDummy) GetApp(ctx context.Context) (*github.GetAppResponse, error) {
 	return &github.GetAppResponse{
+		Slug:    "shogo82148-actions-github-app-token",
 		HTMLURL: "https://github.com/shogo82148/actions-github-app-token",
 	}, nil
 }
@@ -23,8 +24,19 @@ func (c *githubClientDummy) GetRepo(ctx context.Context, token, owner, repo stri
 	}, nil
 }
 
+func (c *githubClientDummy) GetUser(ctx context.Context, token, username string) (*github.GetUserResponse, error) {
+	return &github.GetUserResponse{
+		Login: "shogo82148",
+		ID:    1157344,
+	}, nil
+}
+
 func (c *githubClientDummy) GetReposInfo(ctx context.Context, token, nodeID string) (*github.GetReposInfoResponse, error) {
-	return &github.GetReposInfoResponse{}, nil
+	return &github.GetReposInfoResponse{
+		Owner: "shogo82148",
+		Name:  "actions-github-app-token",
+		ID:    398574950,
+	}, nil
 }
 
 func (c *githubClientDummy) GetReposContent(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
@@ -60,8 +72,9 @@ func (c *githubClientDummy) ParseIDToken(ctx context.Context, idToken string) (*
 		Claims: &jwt.Claims{
 			Audience: []string{"https://github-app.shogo82148.com/1234567890"},
 		},
-		Repository:   "shogo82148/actions-github-app-token",
-		RepositoryID: "398574950",
+		Repository:        "shogo82148/actions-github-app-token",
+		RepositoryID:      "398574950",
+		RepositoryOwnerID: "1157344",
 	}, nil
 }
 
@@ -73,5 +86,6 @@ func NewDummyHandler() *Handler {
 	return &Handler{
 		github: &githubClientDummy{},
 		appID:  1234567890,
+		tokens: newMemoryTokenStore(),
 	}
 }
@@ -12,12 +12,13 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
-	"github.com/goccy/go-yaml"
 	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
 	"github.com/shogo82148/aws-xray-yasdk-go/xray"
 	"github.com/shogo82148/aws-xray-yasdk-go/xrayhttp"
@@ -28,6 +29,7 @@ type githubClient interface {
 	GetApp(ctx context.Context) (*github.GetAppResponse, error)
 	GetReposInstallation(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error)
 	GetRepo(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error)
+	GetUser(ctx context.Context, token, username string) (*github.GetUserResponse, error)
 	GetReposInfo(ctx context.Context, token, nodeID string) (*github.GetReposInfoResponse, error)
 	GetReposContent(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error)
 	CreateAppAccessToken(ctx context.Context, installationID uint64, permissions *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error)
@@ -44,12 +46,63 @@ type Handler struct {
 	github githubClient
 	app    *github.GetAppResponse
 	appID  uint64
+
+	// policy is the policy of the operator. nil means no restriction.
+	policy *operatorPolicy
+
+	// apps are the handlers for each app, if several apps are behind the API.
+	// The requests are routed by the audience of the OIDC token and the url of GitHub API.
+	// nil means that h itself is the only app.
+	apps []*Handler
+
+	// tokens records the issued tokens for the revocation. nil disables the revocation.
+	tokens tokenStore
+
+	// replay counts the uses of the OIDC tokens. nil disables the replay protection.
+	replay replayStore
+
+	// maxUses is how many times an OIDC token can issue the tokens. 0 means unlimited.
+	maxUses int64
+
+	// noreply is the domain of the noreply email addresses on the GitHub API of the app.
+	// Empty means users.noreply.github.com.
+	noreply string
+
+	// bot is the cache of the bot user of the app.
+	botMu sync.Mutex
+	bot   *github.GetUserResponse
 }
 
 func errAttr(err error) slog.Attr {
 	return slog.String("error", err.Error())
 }
 
+// claimsAttr returns the claims of the OIDC token for the audit logs.
+func claimsAttr(id *github.ActionsIDToken) slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("repository", id.Repository),
+		slog.String("repository_id", id.RepositoryID),
+		slog.String("repository_owner_id", id.RepositoryOwnerID),
+		slog.String("actor", id.Actor),
+		slog.String("actor_id", id.ActorID),
+		slog.String("event_name", id.EventName),
+		slog.String("ref", id.Ref),
+		slog.String("sha", id.SHA),
+		slog.String("environment", id.Environment),
+		slog.String("workflow_ref", id.WorkflowRef),
+		slog.String("job_workflow_ref", id.JobWorkflowRef),
+		slog.String("run_id", id.RunID),
+		slog.String("run_attempt", id.RunAttempt),
+		slog.String("check_run_id", id.CheckRunID),
+		slog.String("runner_environment", id.RunnerEnvironment),
+		slog.String("enterprise", id.Enterprise),
+	}
+	if id.Claims != nil {
+		attrs = append(attrs, slog.String("sub", id.Subject), slog.String("jti", id.JWTID))
+	}
+	return slog.Attr{Key: "claims", Value: slog.GroupValue(attrs...)}
+}
+
 func NewHandler() (*Handler, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -62,43 +115,128 @@ func NewHandler() (*Handler, error) {
 	}
 	svc := ssm.NewFromConfig(cfg)
 
-	appIDParam, err := svc.GetParameter(ctx, &ssm.GetParameterInput{
-		Name: aws.String(os.Getenv("GITHUB_APP_ID")),
-	})
+	policy, err := loadOperatorPolicy(ctx, svc)
 	if err != nil {
 		return nil, err
 	}
-	appID, err := strconv.ParseUint(aws.ToString(appIDParam.Parameter.Value), 10, 64)
+	kmssvc := kms.NewFromConfig(cfg)
+	client := xrayhttp.Client(http.DefaultClient)
+	replay, maxUses, err := newReplayStore(cfg)
 	if err != nil {
 		return nil, err
 	}
+	h := &Handler{
+		policy:  policy,
+		tokens:  newTokenStore(cfg),
+		replay:  replay,
+		maxUses: maxUses,
+	}
 
-	kmsID := os.Getenv("GITHUB_APP_KMS_KEY_ID")
-	kmssvc := kms.NewFromConfig(cfg)
+	// several apps behind the API.
+	if apps := os.Getenv("GITHUB_APPS"); apps != "" {
+		configs, err := parseAppConfigs([]byte(apps))
+		if err != nil {
+			return nil, fmt.Errorf("invalid GITHUB_APPS: %w", err)
+		}
+		h.apps = make([]*Handler, 0, len(configs))
+		for _, c := range configs {
+			app, err := h.newAppHandler(ctx, c, client, kmssvc, svc)
+			if err != nil {
+				return nil, err
+			}
+			h.apps = append(h.apps, app)
+		}
+		return h, nil
+	}
 
-	client := xrayhttp.Client(http.DefaultClient)
-	c, err := github.NewClient(client, appID, kmssvc, kmsID)
+	appIDParam, err := svc.GetParameter(ctx, &ssm.GetParameterInput{
+		Name: aws.String(os.Getenv("GITHUB_APP_ID")),
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	app, err := c.GetApp(ctx)
+	appID, err := strconv.ParseUint(aws.ToString(appIDParam.Parameter.Value), 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get the app information, check your configure: %w", err)
+		return nil, err
 	}
-
-	return &Handler{
-		github: c,
-		app:    app,
-		appID:  appID,
-	}, nil
+	var trusted []*trustedIssuerConfig
+	if v := os.Getenv("GITHUB_OIDC_TRUSTED_ISSUERS"); v != "" {
+		trusted, err = parseTrustedIssuers([]byte(v))
+		if err != nil {
+			return nil, fmt.Errorf("invalid GITHUB_OIDC_TRUSTED_ISSUERS: %w", err)
+		}
+	}
+	return h.newAppHandler(ctx, &appConfig{
+		AppID:          appID,
+		KMSKeyID:       os.Getenv("GITHUB_APP_KMS_KEY_ID"),
+		APIURL:         os.Getenv("GITHUB_API_URL"),
+		Issuer:         os.Getenv("GITHUB_OIDC_ISSUER"),
+		TrustedIssuers: trusted,
+		JWKSFile:       os.Getenv("GITHUB_OIDC_JWKS_FILE"),
+		JWKSParameter:  os.Getenv("GITHUB_OIDC_JWKS_PARAMETER"),
+	}, client, kmssvc, svc)
 }
 
 // requestBody is the request body for the token request.
 type requestBody struct {
-	APIURL       string       `json:"api_url"`
-	Repositories []string     `json:"repositories"`
-	Permissions  *permissions `json:"permissions,omitempty"`
+	APIURL       string          `json:"api_url"`
+	Repositories []repositoryRef `json:"repositories"`
+	Permissions  *permissions    `json:"permissions,omitempty"`
+
+	// DryRun makes the handler explain the decision of the policies without issuing the token.
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// Scope is the scope of the token; "repository" or "organization".
+	// The default is "repository", and the token can access only the repositories in the request.
+	// With "organization", the token can access all repositories of the installation.
+	Scope string `json:"scope,omitempty"`
+}
+
+const (
+	scopeRepository   = "repository"
+	scopeOrganization = "organization"
+)
+
+// repositoryRef is a repository in the token request.
+// In JSON, it is either a string, the global node id or "owner/repo",
+// or an object with either node_id or repository.
+type repositoryRef struct {
+	// NodeID is the global node id of the repository.
+	NodeID string `json:"node_id,omitempty"`
+
+	// Repository is the full name of the repository, such as "shogo82148/actions-github-app-token".
+	Repository string `json:"repository,omitempty"`
+}
+
+func (r *repositoryRef) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		if strings.Contains(s, "/") {
+			*r = repositoryRef{Repository: s}
+		} else {
+			*r = repositoryRef{NodeID: s}
+		}
+		return nil
+	}
+
+	type plain repositoryRef
+	var ref plain
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return err
+	}
+	if ref.NodeID != "" && ref.Repository != "" {
+		return errors.New("only one of node_id and repository can be set")
+	}
+	*r = repositoryRef(ref)
+	return nil
+}
+
+// String returns the node id or the full name of the repository.
+func (r repositoryRef) String() string {
+	if r.NodeID != "" {
+		return r.NodeID
+	}
+	return r.Repository
 }
 
 // permissions is the permissions for the token request.
@@ -160,9 +298,42 @@ type permissions struct {
 }
 
 type responseBody struct {
-	GitHubToken string `json:"github_token"`
-	Message     string `json:"message,omitempty"`
-	Warning     string `json:"warning,omitempty"`
+	// the token for the installation of the repository that requests the token.
+	installationToken
+
+	// GitAuthorName and GitAuthorEmail are the identity of the bot user of the app for git commits.
+	GitAuthorName  string `json:"git_author_name,omitempty"`
+	GitAuthorEmail string `json:"git_author_email,omitempty"`
+
+	Message string        `json:"message,omitempty"`
+	Warning string        `json:"warning,omitempty"`
+	DryRun  *dryRunResult `json:"dry_run,omitempty"`
+
+	// Tokens are the tokens for each installation of the app,
+	// if the repositories in the request span several installations.
+	// The first one is the same as the embedded token.
+	Tokens []*installationToken `json:"tokens,omitempty"`
+}
+
+// installationToken is the token for an installation of the app, and what GitHub granted to it.
+type installationToken struct {
+	GitHubToken string    `json:"github_token,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitzero"`
+
+	// Permissions are the permissions that the token has actually.
+	Permissions map[string]string `json:"permissions,omitempty"`
+
+	// RepositorySelection is "all" or "selected".
+	RepositorySelection string `json:"repository_selection,omitempty"`
+
+	// Repositories are the full names of the repositories that the token can access,
+	// if RepositorySelection is "selected".
+	Repositories []string `json:"repositories,omitempty"`
+
+	InstallationID uint64 `json:"installation_id,omitempty"`
+
+	// Account is the login of the account that the app is installed in.
+	Account string `json:"account,omitempty"`
 }
 
 type errorResponseBody struct {
@@ -196,6 +367,10 @@ func (err *forbiddenError) Unwrap() error {
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	if r.URL.Path == "/revoke" {
+		h.serveRevoke(w, r)
+		return
+	}
 	if r.Method != http.MethodPost {
 		h.handleMethodNotAllowed(w)
 		return
@@ -232,12 +407,34 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) handle(ctx context.Context, token string, req *requestBody) (*responseBody, error) {
+	app, err := h.selectApp(token, req.APIURL)
+	if err != nil {
+		return nil, err
+	}
+	return app.handleApp(ctx, token, req)
+}
+
+func (h *Handler) handleApp(ctx context.Context, token string, req *requestBody) (*responseBody, error) {
 	if err := h.github.ValidateAPIURL(req.APIURL); err != nil {
 		return nil, &validationError{
 			message: err.Error(),
 		}
 	}
 
+	switch req.Scope {
+	case "", scopeRepository:
+	case scopeOrganization:
+		if len(req.Repositories) > 0 {
+			return nil, &validationError{
+				message: "repositories can't be set with the organization scope",
+			}
+		}
+	default:
+		return nil, &validationError{
+			message: fmt.Sprintf("invalid scope: %q", req.Scope),
+		}
+	}
+
 	// authorize the request
 	id, err := h.validateToken(ctx, token)
 	if err != nil {
@@ -247,6 +444,9 @@ func (h *Handler) handle(ctx context.Context, token string, req *requestBody) (*
 	if err != nil {
 		return nil, err
 	}
+	if err := h.policy.check(id.Repository); err != nil {
+		return nil, &forbiddenError{err: err}
+	}
 
 	// issue a new access token
 	inst, err := h.github.GetReposInstallation(ctx, owner, repo)
@@ -270,82 +470,108 @@ func (h *Handler) handle(ctx context.Context, token string, req *requestBody) (*
 	if err != nil {
 		return nil, err
 	}
-	repoIDs, err := h.getRepositoryIDs(ctx, inst.ID, repoID, owner, repo, req.Repositories)
-	if err != nil {
-		return nil, err
-	}
-
-	var permissions *github.CreateAppAccessTokenRequestPermissions
-	if p := req.Permissions; p != nil {
-		permissions = &github.CreateAppAccessTokenRequestPermissions{
-			Actions:                          p.Actions,
-			Administration:                   p.Administration,
-			ArtifactMetadata:                 p.ArtifactMetadata,
-			Attestations:                     p.Attestations,
-			Checks:                           p.Checks,
-			Codespaces:                       p.Codespaces,
-			Contents:                         p.Contents,
-			CustomPropertiesForOrganizations: p.CustomPropertiesForOrganizations,
-			DependabotSecrets:                p.DependabotSecrets,
-			Deployments:                      p.Deployments,
-			Discussions:                      p.Discussions,
-			EmailAddresses:                   p.EmailAddresses,
-			EnterpriseCustomPropertiesForOrganizations: p.EnterpriseCustomPropertiesForOrganizations,
-			Environments:                            p.Environments,
-			Followers:                               p.Followers,
-			GitSSHKeys:                              p.GitSSHKeys,
-			GPGKeys:                                 p.GPGKeys,
-			InteractionLimits:                       p.InteractionLimits,
-			Issues:                                  p.Issues,
-			Members:                                 p.Members,
-			MergeQueues:                             p.MergeQueues,
-			Metadata:                                p.Metadata,
-			OrganizationAdministration:              p.OrganizationAdministration,
-			OrganizationAnnouncementBanners:         p.OrganizationAnnouncementBanners,
-			OrganizationCopilotSeatManagement:       p.OrganizationCopilotSeatManagement,
-			OrganizationCustomOrgRoles:              p.OrganizationCustomOrgRoles,
-			OrganizationCustomProperties:            p.OrganizationCustomProperties,
-			OrganizationCustomRoles:                 p.OrganizationCustomRoles,
-			OrganizationEvents:                      p.OrganizationEvents,
-			OrganizationHooks:                       p.OrganizationHooks,
-			OrganizationPackages:                    p.OrganizationPackages,
-			OrganizationPersonalAccessTokenRequests: p.OrganizationPersonalAccessTokenRequests,
-			OrganizationPersonalAccessTokens:        p.OrganizationPersonalAccessTokens,
-			OrganizationPlan:                        p.OrganizationPlan,
-			OrganizationProjects:                    p.OrganizationProjects,
-			OrganizationSecrets:                     p.OrganizationSecrets,
-			OrganizationSelfHostedRunners:           p.OrganizationSelfHostedRunners,
-			OrganizationUserBlocking:                p.OrganizationUserBlocking,
-			Packages:                                p.Packages,
-			Pages:                                   p.Pages,
-			Profile:                                 p.Profile,
-			PullRequests:                            p.PullRequests,
-			RepositoryCustomProperties:              p.RepositoryCustomProperties,
-			RepositoryHooks:                         p.RepositoryHooks,
-			RepositoryProjects:                      p.RepositoryProjects,
-			SecretScanningAlerts:                    p.SecretScanningAlerts,
-			Secrets:                                 p.Secrets,
-			SecurityEvents:                          p.SecurityEvents,
-			SingleFile:                              p.SingleFile,
-			Starring:                                p.Starring,
-			Statuses:                                p.Statuses,
-			TeamDiscussions:                         p.TeamDiscussions,
-			VulnerabilityAlerts:                     p.VulnerabilityAlerts,
-			Workflows:                               p.Workflows,
-		}
-	}
-
-	resp, err := h.github.CreateAppAccessToken(ctx, inst.ID, &github.CreateAppAccessTokenRequest{
-		RepositoryIDs: repoIDs,
-		Permissions:   permissions,
-	})
+	if req.DryRun {
+		result, err := h.dryRun(ctx, inst, id, repoID, owner, repo, req)
+		if err != nil {
+			return nil, err
+		}
+		return &responseBody{
+			DryRun: result,
+		}, nil
+	}
+	var grants []*installationGrant
+	if req.Scope == scopeOrganization {
+		// the token can access all repositories of the installation.
+		ceiling, err := h.getOrganizationPermissions(ctx, inst, id, repoID, owner, repo, req)
+		if err != nil {
+			return nil, err
+		}
+		grants = []*installationGrant{{
+			Installation: inst,
+			Owner:        owner,
+			Permissions:  ceiling,
+		}}
+	} else {
+		grants, err = h.getRepositoryIDs(ctx, inst, id, repoID, owner, repo, req)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the token is checked just before issuing, so the denied requests don't use up the token.
+	// the use is refunded if no token is issued, so that the caller can retry.
+	if err := h.checkReplay(ctx, id); err != nil {
+		return nil, err
+	}
+	resp, err := h.createTokens(ctx, id, grants, req)
 	if err != nil {
-		return nil, fmt.Errorf("failed create access token: %w", err)
+		h.refundReplay(ctx, id)
+		return nil, err
 	}
+	return resp, nil
+}
 
-	return &responseBody{
-		GitHubToken: resp.Token,
-	}, nil
+// toGitHub converts the permissions into the request for GitHub.
+func (p *permissions) toGitHub() *github.CreateAppAccessTokenRequestPermissions {
+	if p == nil {
+		return nil
+	}
+	return &github.CreateAppAccessTokenRequestPermissions{
+		Actions:                          p.Actions,
+		Administration:                   p.Administration,
+		ArtifactMetadata:                 p.ArtifactMetadata,
+		Attestations:                     p.Attestations,
+		Checks:                           p.Checks,
+		Codespaces:                       p.Codespaces,
+		Contents:                         p.Contents,
+		CustomPropertiesForOrganizations: p.CustomPropertiesForOrganizations,
+		DependabotSecrets:                p.DependabotSecrets,
+		Deployments:                      p.Deployments,
+		Discussions:                      p.Discussions,
+		EmailAddresses:                   p.EmailAddresses,
+		EnterpriseCustomPropertiesForOrganizations: p.EnterpriseCustomPropertiesForOrganizations,
+		Environments:                            p.Environments,
+		Followers:                               p.Followers,
+		GitSSHKeys:                              p.GitSSHKeys,
+		GPGKeys:                                 p.GPGKeys,
+		InteractionLimits:                       p.InteractionLimits,
+		Issues:                                  p.Issues,
+		Members:                                 p.Members,
+		MergeQueues:                             p.MergeQueues,
+		Metadata:                                p.Metadata,
+		OrganizationAdministration:              p.OrganizationAdministration,
+		OrganizationAnnouncementBanners:         p.OrganizationAnnouncementBanners,
+		OrganizationCopilotSeatManagement:       p.OrganizationCopilotSeatManagement,
+		OrganizationCustomOrgRoles:              p.OrganizationCustomOrgRoles,
+		OrganizationCustomProperties:            p.OrganizationCustomProperties,
+		OrganizationCustomRoles:                 p.OrganizationCustomRoles,
+		OrganizationEvents:                      p.OrganizationEvents,
+		OrganizationHooks:                       p.OrganizationHooks,
+		OrganizationPackages:                    p.OrganizationPackages,
+		OrganizationPersonalAccessTokenRequests: p.OrganizationPersonalAccessTokenRequests,
+		OrganizationPersonalAccessTokens:        p.OrganizationPersonalAccessTokens,
+		OrganizationPlan:                        p.OrganizationPlan,
+		OrganizationProjects:                    p.OrganizationProjects,
+		OrganizationSecrets:                     p.OrganizationSecrets,
+		OrganizationSelfHostedRunners:           p.OrganizationSelfHostedRunners,
+		OrganizationUserBlocking:                p.OrganizationUserBlocking,
+		Packages:                                p.Packages,
+		Pages:                                   p.Pages,
+		Profile:                                 p.Profile,
+		PullRequests:                            p.PullRequests,
+		RepositoryCustomProperties:              p.RepositoryCustomProperties,
+		RepositoryHooks:                         p.RepositoryHooks,
+		RepositoryProjects:                      p.RepositoryProjects,
+		SecretScanningAlerts:                    p.SecretScanningAlerts,
+		Secrets:                                 p.Secrets,
+		SecurityEvents:                          p.SecurityEvents,
+		SingleFile:                              p.SingleFile,
+		Starring:                                p.Starring,
+		Statuses:                                p.Statuses,
+		TeamDiscussions:                         p.TeamDiscussions,
+		VulnerabilityAlerts:                     p.VulnerabilityAlerts,
+		Workflows:                               p.Workflows,
+	}
 }
 
 // validateToken validates the token and returns the token's payload.
@@ -364,104 +590,755 @@ func (h *Handler) validateToken(ctx context.Context, token string) (*github.Acti
 	return id, nil
 }
 
-func (h *Handler) getRepositoryIDs(ctx context.Context, inst, repoID uint64, owner, repo string, nodeIDs []string) ([]uint64, error) {
-	if len(nodeIDs) == 0 {
-		return []uint64{repoID}, nil
+// operatorCeiling applies the operator policy to the maximum permissions for the token.
+func (h *Handler) operatorCeiling(owner string, ceiling permissionSet, inst *github.GetReposInstallationResponse) (permissionSet, error) {
+	ceiling = ceiling.intersect(h.policy.ceiling(owner))
+	return h.policy.ban(ceiling, permissionSet(inst.Permissions))
+}
+
+// clampPermissions limits the requested permissions to the ceiling.
+// If the request has no permissions, it requests the ceiling itself within installed,
+// the permissions of the installation, because GitHub rejects the permissions that the installation doesn't have.
+// installed may be nil if it is unknown.
+// GitHub treats the empty permissions as all the permissions of the installation,
+// so the empty request is the same as no request, and the empty ceiling allows nothing.
+func clampPermissions(ceiling, installed permissionSet, requested *permissions) (*permissions, error) {
+	if ceiling == nil {
+		return requested, nil
+	}
+	if len(ceiling) == 0 {
+		return nil, &forbiddenError{err: errors.New("no permissions are allowed")}
+	}
+	set := requested.toPermissionSet()
+	if len(set) == 0 {
+		ceiling = ceiling.intersect(installed)
+		if len(ceiling) == 0 {
+			return nil, &forbiddenError{err: errors.New("the installation has none of the allowed permissions")}
+		}
+		return ceiling.toPermissions()
+	}
+	if err := ceiling.check(set); err != nil {
+		return nil, &forbiddenError{err: err}
 	}
+	return requested, nil
+}
 
-	resp, err := h.github.CreateAppAccessToken(ctx, inst, &github.CreateAppAccessTokenRequest{
-		Permissions: &github.CreateAppAccessTokenRequestPermissions{
-			SingleFile: "read",
-		},
-	})
+// grant is the result of the permission check.
+type grant struct {
+	// ID is the id of the repository.
+	ID uint64
+
+	// Owner and Name are the full name of the repository.
+	Owner string
+	Name  string
+
+	// Installation is the installation of the app that can access the repository.
+	Installation *github.GetReposInstallationResponse
+
+	// Permissions is the maximum permissions for the repository.
+	// nil means no restriction.
+	Permissions permissionSet
+}
+
+// installationGrant is the repositories that a token can access in an installation of the app.
+type installationGrant struct {
+	// Installation is the installation of the app.
+	Installation *github.GetReposInstallationResponse
+
+	// Owner is the account that the app is installed in.
+	Owner string
+
+	// RepositoryIDs are the ids of the repositories that the token can access.
+	// Empty means all repositories of the installation.
+	RepositoryIDs []uint64
+
+	// Permissions is the maximum permissions for the token.
+	// nil means no restriction.
+	Permissions permissionSet
+}
+
+// getRepositoryIDs returns the repositories that the tokens can access, grouped by the installations of the app.
+// The first group is for the installation of the repository that requests the token.
+func (h *Handler) getRepositoryIDs(ctx context.Context, inst *github.GetReposInstallationResponse, id *github.ActionsIDToken, repoID uint64, owner, repo string, req *requestBody) ([]*installationGrant, error) {
+	refs := req.Repositories
+	tokens := newPolicyTokens(h)
+	defer tokens.revoke(ctx)
+	token, err := tokens.get(ctx, inst.ID)
 	if err != nil {
-		return nil, fmt.Errorf("failed create access token: %w", err)
+		return nil, err
 	}
-	token := resp.Token
-	defer h.github.RevokeAppAccessToken(ctx, token)
 
-	detail, err := h.github.GetRepo(ctx, token, owner, repo)
+	preq, err := h.newPolicyRequest(ctx, token, id, repoID, owner, repo, req)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get the repo: %w", err)
+		return nil, err
 	}
-	if detail.ID != repoID {
-		return nil, fmt.Errorf("repo id is mismatch")
+
+	// the repository may restrict the tokens for itself.
+	ceiling, err := h.checkSelfPermission(ctx, token, owner, repo, preq)
+	if err != nil {
+		slog.DebugContext(ctx, "permission denied", errAttr(err), slog.String("repository_node_id", preq.From.NodeID))
+		return nil, permissionError(err)
+	}
+	self := &installationGrant{
+		Installation:  inst,
+		Owner:         owner,
+		RepositoryIDs: []uint64{repoID},
+		Permissions:   ceiling,
 	}
+	if len(refs) == 0 {
+		return []*installationGrant{self}, nil
+	}
+
+	// the names in the policies are resolved from the view of the caller.
+	resolver := newGitHubResolver(h.github, token)
+	orgs := newOrgPolicyCache()
 
-	ch := make(chan uint64, len(nodeIDs))
+	grants := make([]*grant, len(refs))
 	g, ctx := errgroup.WithContext(ctx)
-	for _, nodeID := range nodeIDs {
-		if nodeID == "" {
+	for i, ref := range refs {
+		if ref.String() == "" {
 			continue
 		}
-		nodeID := nodeID
 		g.Go(func() error {
-			id, err := h.checkPermission(ctx, token, nodeID, detail.NodeID)
+			grant, err := h.checkPermission(ctx, tokens, inst, owner, ref, preq, resolver, orgs)
 			if err != nil {
-				slog.DebugContext(ctx, "permission denied", errAttr(err), slog.String("repository_node_id", nodeID))
+				slog.DebugContext(ctx, "permission denied", errAttr(err), slog.String("repository", ref.String()))
 				return err
 			}
-			ch <- id
+			grants[i] = grant
 			return nil
 		})
 	}
 	if err := g.Wait(); err != nil {
-		return nil, &forbiddenError{err: err}
+		return nil, permissionError(err)
 	}
-	close(ch)
 
-	ret := make([]uint64, 0, len(nodeIDs)+1)
-	ret = append(ret, repoID)
-	for id := range ch {
-		ret = append(ret, id)
+	return groupGrants(self, grants), nil
+}
+
+// groupGrants groups the grants by the installations of the app.
+// self is the group for the installation of the repository that requests the token, and it comes first.
+// The nil grants are skipped.
+func groupGrants(self *installationGrant, grants []*grant) []*installationGrant {
+	ret := []*installationGrant{self}
+	installations := map[uint64]*installationGrant{self.Installation.ID: self}
+	for _, grant := range grants {
+		if grant == nil {
+			continue
+		}
+		group, ok := installations[grant.Installation.ID]
+		if !ok {
+			group = &installationGrant{
+				Installation: grant.Installation,
+				Owner:        grant.Owner,
+				Permissions:  grant.Permissions,
+			}
+			installations[grant.Installation.ID] = group
+			ret = append(ret, group)
+		} else {
+			group.Permissions = group.Permissions.intersect(grant.Permissions)
+		}
+		group.RepositoryIDs = append(group.RepositoryIDs, grant.ID)
+	}
+	return ret
+}
+
+// createTokens creates a token for each installation.
+// It checks all the permissions before creating any token,
+// and revokes the created tokens if it fails to create one of them.
+func (h *Handler) createTokens(ctx context.Context, id *github.ActionsIDToken, grants []*installationGrant, req *requestBody) (*responseBody, error) {
+	perms := make([]*permissions, len(grants))
+	for i, g := range grants {
+		ceiling, err := h.operatorCeiling(g.Owner, g.Permissions, g.Installation)
+		if err != nil {
+			return nil, err
+		}
+		perms[i], err = clampPermissions(ceiling, permissionSet(g.Installation.Permissions), req.Permissions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tokens := make([]*installationToken, 0, len(grants))
+	for i, g := range grants {
+		resp, err := h.github.CreateAppAccessToken(ctx, g.Installation.ID, &github.CreateAppAccessTokenRequest{
+			RepositoryIDs: g.RepositoryIDs,
+			Permissions:   perms[i].toGitHub(),
+		})
+		if err != nil {
+			for _, t := range tokens {
+				if err := h.github.RevokeAppAccessToken(ctx, t.GitHubToken); err != nil {
+					slog.WarnContext(ctx, "failed to revoke the token", errAttr(err))
+				}
+			}
+			return nil, fmt.Errorf("failed create access token: %w", err)
+		}
+		tokens = append(tokens, newInstallationToken(g, resp))
+	}
+	h.recordTokens(ctx, id, tokens)
+	for _, t := range tokens {
+		slog.InfoContext(
+			ctx, "the token is issued",
+			claimsAttr(id),
+			slog.Uint64("installation_id", t.InstallationID),
+			slog.Any("repositories", t.Repositories),
+			slog.Any("permissions", t.Permissions),
+		)
+	}
+
+	ret := &responseBody{
+		installationToken: *tokens[0],
+	}
+	if len(tokens) > 1 {
+		ret.Tokens = tokens
+	}
+
+	// the identity is a convenience, so the token is returned even if it is unknown.
+	if bot, err := h.getBotUser(ctx, ret.GitHubToken); err != nil {
+		slog.WarnContext(ctx, "failed to get the bot user", errAttr(err))
+	} else if bot != nil {
+		ret.GitAuthorName = bot.Login
+		noreply := h.noreply
+		if noreply == "" {
+			noreply = "users.noreply.github.com"
+		}
+		ret.GitAuthorEmail = fmt.Sprintf("%d+%s@%s", bot.ID, bot.Login, noreply)
 	}
 	return ret, nil
 }
 
-func (h *Handler) checkPermission(ctx context.Context, token, to, from string) (uint64, error) {
-	slog.DebugContext(ctx, "checking permission", slog.String("repository_node_id", to))
-	info, err := h.github.GetReposInfo(ctx, token, to)
+// getBotUser returns the bot user of the app, such as "octoapp[bot]".
+// It returns nil if the slug of the app is unknown.
+// token is any installation token; the users API doesn't accept the JWT of the app.
+func (h *Handler) getBotUser(ctx context.Context, token string) (*github.GetUserResponse, error) {
+	if h.app == nil || h.app.Slug == "" {
+		return nil, nil
+	}
+
+	h.botMu.Lock()
+	defer h.botMu.Unlock()
+	if h.bot != nil {
+		return h.bot, nil
+	}
+	bot, err := h.github.GetUser(ctx, token, h.app.Slug+"[bot]")
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	h.bot = bot
+	return bot, nil
+}
 
-	slog.DebugContext(ctx, "fetching .github/actions.yaml", slog.String("repository_node_id", to))
-	resp, err := h.github.GetReposContent(ctx, token, info.Owner, info.Name, ".github/actions.yaml")
-	if err == nil {
-		return h.checkConfig(ctx, info, resp, from)
-	} else if status, ok := githubStatusCode(err); !ok || status != http.StatusNotFound {
-		return 0, fmt.Errorf("failed to fetch .github/actions.yaml: %w", err)
+func newInstallationToken(g *installationGrant, resp *github.CreateAppAccessTokenResponse) *installationToken {
+	account := g.Owner
+	if a := g.Installation.Account; a != nil && a.Login != "" {
+		account = a.Login
+	}
+	var repos []string
+	for _, repo := range resp.Repositories {
+		repos = append(repos, repo.FullName)
+	}
+	return &installationToken{
+		GitHubToken:         resp.Token,
+		ExpiresAt:           resp.ExpiresAt,
+		Permissions:         resp.Permissions,
+		RepositorySelection: resp.RepositorySelection,
+		Repositories:        repos,
+		InstallationID:      g.Installation.ID,
+		Account:             account,
 	}
-	slog.DebugContext(ctx, ".github/actions.yaml not found", slog.String("repository_node_id", to))
+}
 
-	slog.DebugContext(ctx, "fetching .github/actions.yml", slog.String("repository_node_id", to))
-	resp, err = h.github.GetReposContent(ctx, token, info.Owner, info.Name, ".github/actions.yml")
-	if err == nil {
-		return h.checkConfig(ctx, info, resp, from)
-	} else if status, ok := githubStatusCode(err); !ok || status != http.StatusNotFound {
-		return 0, fmt.Errorf("failed to fetch .github/actions.yml: %w", err)
+// getOrganizationPermissions returns the maximum permissions for the token without repository restriction.
+func (h *Handler) getOrganizationPermissions(ctx context.Context, inst *github.GetReposInstallationResponse, id *github.ActionsIDToken, repoID uint64, owner, repo string, req *requestBody) (permissionSet, error) {
+	token, err := h.createPolicyToken(ctx, inst.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer h.github.RevokeAppAccessToken(ctx, token)
+
+	preq, err := h.newPolicyRequest(ctx, token, id, repoID, owner, repo, req)
+	if err != nil {
+		return nil, err
+	}
+	ceiling, err := h.checkOrganizationPermission(ctx, token, inst, owner, repo, preq)
+	if err != nil {
+		slog.DebugContext(ctx, "permission denied", errAttr(err), slog.String("owner", owner))
+		return nil, permissionError(err)
+	}
+	return ceiling, nil
+}
+
+// createPolicyToken creates a token to read the policy files.
+// The caller must revoke it after use.
+func (h *Handler) createPolicyToken(ctx context.Context, inst uint64) (string, error) {
+	resp, err := h.github.CreateAppAccessToken(ctx, inst, &github.CreateAppAccessTokenRequest{
+		Permissions: &github.CreateAppAccessTokenRequestPermissions{
+			SingleFile: "read",
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed create access token: %w", err)
+	}
+	return resp.Token, nil
+}
+
+// policyTokens creates the tokens to read the policy files for each installation on demand,
+// and revokes them at once.
+type policyTokens struct {
+	h *Handler
+
+	mu     sync.Mutex
+	tokens map[uint64]string
+}
+
+func newPolicyTokens(h *Handler) *policyTokens {
+	return &policyTokens{
+		h:      h,
+		tokens: make(map[uint64]string),
+	}
+}
+
+// get returns the token for the installation.
+func (t *policyTokens) get(ctx context.Context, inst uint64) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if token, ok := t.tokens[inst]; ok {
+		return token, nil
+	}
+	token, err := t.h.createPolicyToken(ctx, inst)
+	if err != nil {
+		return "", err
+	}
+	t.tokens[inst] = token
+	return token, nil
+}
+
+// revoke revokes all tokens.
+func (t *policyTokens) revoke(ctx context.Context) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for inst, token := range t.tokens {
+		t.h.github.RevokeAppAccessToken(ctx, token)
+		delete(t.tokens, inst)
+	}
+}
+
+// newPolicyRequest verifies the repository that requests the token, and builds the request for the policies.
+func (h *Handler) newPolicyRequest(ctx context.Context, token string, id *github.ActionsIDToken, repoID uint64, owner, repo string, req *requestBody) (*policyRequest, error) {
+	detail, err := h.github.GetRepo(ctx, token, owner, repo)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the repo: %w", err)
+	}
+	if detail.ID != repoID {
+		return nil, fmt.Errorf("repo id is mismatch")
+	}
+	ownerID, err := strconv.ParseUint(id.RepositoryOwnerID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository owner id: %w", err)
+	}
+	// the owner may be renamed and its old name may be reused by another account.
+	if detail.Owner != nil && detail.Owner.ID != ownerID {
+		return nil, fmt.Errorf("repository owner id is mismatch")
+	}
+	return &policyRequest{
+		From: &callerRepository{
+			NodeID:  detail.NodeID,
+			ID:      detail.ID,
+			OwnerID: ownerID,
+			Claims:  id,
+		},
+		Permissions: req.Permissions.toPermissionSet(),
+	}, nil
+}
+
+// permissionError converts the error of the permission check into forbiddenError.
+// The errors in the policies are reported as they are, so that the user can fix them.
+func permissionError(err error) error {
+	var validation *validationError
+	if errors.As(err, &validation) {
+		return err
+	}
+	return &forbiddenError{err: err}
+}
+
+// policyError annotates the error in the policy of the repository.
+func policyError(owner, repo string, err error) error {
+	var validation *validationError
+	if errors.As(err, &validation) {
+		return &validationError{
+			message: fmt.Sprintf("invalid policy in %s/%s: %v", owner, repo, err),
+			err:     err,
+		}
+	}
+	return fmt.Errorf("invalid policy in %s/%s: %w", owner, repo, err)
+}
+
+// checkSelfPermission returns the maximum permissions that the workflows of the repository can receive for itself.
+func (h *Handler) checkSelfPermission(ctx context.Context, token, owner, repo string, req *policyRequest) (permissionSet, error) {
+	content, source, err := h.fetchPolicyFile(ctx, token, owner, repo, ".github/actions.yaml", ".github/actions.yml")
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return nil, nil
+	}
+	config, err := parsePolicy(content)
+	if err != nil {
+		return nil, policyError(owner, repo, err)
+	}
+	config.source = source
+
+	self := *req
+	self.Target = &targetRepository{
+		ID:    req.From.ID,
+		Owner: owner,
+		Name:  repo,
+	}
+	permissions, ok, err := config.selfGrant(ctx, &self)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("permission denied by the self rules")
+	}
+	return permissions, nil
+}
+
+// checkOrganizationPermission returns the maximum permissions that the repository req.From can receive
+// for the token without repository restriction, under the operator policy, the organization policy of the owner,
+// and the self rules of the repository, because the token can access the repository itself too.
+func (h *Handler) checkOrganizationPermission(ctx context.Context, token string, inst *github.GetReposInstallationResponse, owner, repo string, req *policyRequest) (permissionSet, error) {
+	if err := h.policy.checkOrganization(owner); err != nil {
+		return nil, err
+	}
+	org, err := h.getOrgPolicy(ctx, token, inst, owner, newOrgPolicyCache())
+	if err != nil {
+		return nil, err
+	}
+	if org == nil {
+		return nil, errors.New("organization policy is not found")
+	}
+	permissions, ok, err := org.organizationGrant(ctx, req, newGitHubResolver(h.github, token))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("permission denied by the organization rules")
+	}
+	self, err := h.checkSelfPermission(ctx, token, owner, repo, req)
+	if err != nil {
+		return nil, err
+	}
+	return permissions.intersect(self), nil
+}
+
+// checkPermission checks the permission of the repository req.From for the repository to.
+// inst and owner are the installation and the owner of req.From.
+// The repositories of the other owners are resolved in their own installations.
+func (h *Handler) checkPermission(ctx context.Context, tokens *policyTokens, inst *github.GetReposInstallationResponse, owner string, to repositoryRef, req *policyRequest, resolver repositoryResolver, orgs *orgPolicyCache) (*grant, error) {
+	slog.DebugContext(ctx, "checking permission", slog.String("repository", to.String()))
+	inst, err := h.getTargetInstallation(ctx, tokens, inst, owner, to)
+	if err != nil {
+		return nil, err
+	}
+	token, err := tokens.get(ctx, inst.ID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := h.getReposInfo(ctx, token, to)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.policy.check(info.Owner + "/" + info.Name); err != nil {
+		return nil, err
+	}
+
+	org, err := h.getOrgPolicy(ctx, token, inst, info.Owner, orgs)
+	if err != nil {
+		return nil, err
+	}
+
+	content, source, err := h.fetchPolicyFile(ctx, token, info.Owner, info.Name, ".github/actions.yaml", ".github/actions.yml")
+	if err != nil {
+		return nil, err
+	}
+	if content == nil && org == nil {
+		return nil, errors.New("config file is not found")
+	}
+	grant, err := h.checkConfig(ctx, info, org, content, source, req, resolver)
+	if err != nil {
+		return nil, err
+	}
+	grant.Installation = inst
+	grant.Permissions = grant.Permissions.intersect(h.policy.ceiling(info.Owner))
+	return grant, nil
+}
+
+// getTargetInstallation returns the installation of the app that can access the repository.
+// The repositories of the owner are resolved in the installation of the caller,
+// because an account has at most one installation of the app.
+// The node ids are resolved into the owners in the installation of the caller,
+// which can see its own repositories and the public ones.
+func (h *Handler) getTargetInstallation(ctx context.Context, tokens *policyTokens, inst *github.GetReposInstallationResponse, owner string, to repositoryRef) (*github.GetReposInstallationResponse, error) {
+	var targetOwner, targetRepo string
+	if to.NodeID != "" {
+		token, err := tokens.get(ctx, inst.ID)
+		if err != nil {
+			return nil, err
+		}
+		info, err := h.github.GetReposInfo(ctx, token, to.NodeID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the repository %s: %w", to.NodeID, err)
+		}
+		if info.Owner == "" || info.Name == "" {
+			return nil, &validationError{
+				message: fmt.Sprintf(
+					"repository %s is not found in the installation of %s. "+
+						"Use the full name such as owner/repo for the repositories in other installations",
+					to.NodeID, owner,
+				),
+			}
+		}
+		targetOwner, targetRepo = info.Owner, info.Name
+	} else {
+		var err error
+		targetOwner, targetRepo, err = splitOwnerRepo(to.Repository)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if strings.EqualFold(targetOwner, owner) {
+		return inst, nil
+	}
+	target, err := h.github.GetReposInstallation(ctx, targetOwner, targetRepo)
+	if err != nil {
+		if status, ok := githubStatusCode(err); ok && status == http.StatusNotFound {
+			return nil, fmt.Errorf("the app is not installed in %s", to.String())
+		}
+		return nil, fmt.Errorf("failed to get the installation for %s: %w", to.String(), err)
+	}
+	return target, nil
+}
+
+// getReposInfo resolves the repository in the request.
+func (h *Handler) getReposInfo(ctx context.Context, token string, ref repositoryRef) (*github.GetReposInfoResponse, error) {
+	if ref.NodeID != "" {
+		return h.github.GetReposInfo(ctx, token, ref.NodeID)
+	}
+
+	owner, repo, err := splitOwnerRepo(ref.Repository)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.github.GetRepo(ctx, token, owner, repo)
+	if err != nil {
+		if status, ok := githubStatusCode(err); ok && status == http.StatusNotFound {
+			return nil, fmt.Errorf("repository %s is not found", ref.Repository)
+		}
+		return nil, fmt.Errorf("failed to get the repository %s: %w", ref.Repository, err)
 	}
-	slog.DebugContext(ctx, ".github/actions.yml not found", slog.String("repository_node_id", to))
 
-	return 0, errors.New("config file is not found")
+	// use the name in the response, because the request may differ in case or use an old name.
+	owner, repo, err = splitOwnerRepo(resp.FullName)
+	if err != nil {
+		return nil, err
+	}
+	return &github.GetReposInfoResponse{
+		Owner: owner,
+		Name:  repo,
+		ID:    resp.ID,
+	}, nil
 }
 
-func (h *Handler) checkConfig(ctx context.Context, info *github.GetReposInfoResponse, resp *github.GetReposContentResponse, from string) (uint64, error) {
-	content, err := resp.ParseFile()
+// checkConfig checks the permission of the repository req.From under the organization policy and the repository policy.
+// org is nil if the owner has no organization policy, and content is nil if the repository has no policy file.
+// source is the location of the policy file.
+func (h *Handler) checkConfig(ctx context.Context, info *github.GetReposInfoResponse, org *orgPolicyConfig, content []byte, source string, req *policyRequest, resolver repositoryResolver) (*grant, error) {
+	var repo *policyConfig
+	if content != nil {
+		var err error
+		repo, err = parsePolicy(content)
+		if err != nil {
+			return nil, policyError(info.Owner, info.Name, err)
+		}
+		repo.source = source
+	}
+
+	target := *req
+	target.Target = &targetRepository{
+		ID:    info.ID,
+		Owner: info.Owner,
+		Name:  info.Name,
+	}
+	permissions, ok, err := evaluatePolicies(ctx, org, repo, &target, resolver)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	var config struct {
-		Repositories []string `yaml:"repositories"`
+	if !ok {
+		return nil, errors.New("permission denied")
 	}
-	if err := yaml.Unmarshal(content, &config); err != nil {
-		return 0, err
+	return &grant{
+		ID:          info.ID,
+		Owner:       info.Owner,
+		Name:        info.Name,
+		Permissions: permissions,
+	}, nil
+}
+
+// orgPolicyCache caches the organization policies while handling a request.
+type orgPolicyCache struct {
+	mu       sync.Mutex
+	policies map[string]*orgPolicyConfig
+}
+
+func newOrgPolicyCache() *orgPolicyCache {
+	return &orgPolicyCache{
+		policies: make(map[string]*orgPolicyConfig),
 	}
+}
 
-	if slices.Contains(config.Repositories, from) {
-		return info.ID, nil
+// getOrgPolicy gets the organization policy from the <owner>/.github repository.
+// inst is the installation of the app in the owner, and token is for it.
+// It returns nil if the owner has no organization policy.
+func (h *Handler) getOrgPolicy(ctx context.Context, token string, inst *github.GetReposInstallationResponse, owner string, cache *orgPolicyCache) (*orgPolicyConfig, error) {
+	key := strings.ToLower(owner)
+	cache.mu.Lock()
+	config, ok := cache.policies[key]
+	cache.mu.Unlock()
+	if ok {
+		return config, nil
 	}
-	return 0, errors.New("permission denied")
+
+	content, source, err := h.fetchPolicyFile(ctx, token, owner, ".github", ".github/org-actions.yaml", ".github/org-actions.yml")
+	if err != nil {
+		return nil, err
+	}
+	if content != nil {
+		config, err = parseOrgPolicy(content)
+		if err != nil {
+			return nil, policyError(owner, ".github", err)
+		}
+		config.source = source
+	} else if err := h.checkOrgPolicyRepository(ctx, token, inst, owner); err != nil {
+		return nil, err
+	}
+
+	cache.mu.Lock()
+	cache.policies[key] = config
+	cache.mu.Unlock()
+	return config, nil
+}
+
+// checkOrgPolicyRepository checks that the organization policy is not found because it doesn't exist.
+// GitHub hides the private <owner>/.github repository from the installation that doesn't include it,
+// and then its deny rules would be skipped silently.
+// So the installation must include the repository, unless it includes all repositories of the owner.
+func (h *Handler) checkOrgPolicyRepository(ctx context.Context, token string, inst *github.GetReposInstallationResponse, owner string) error {
+	if inst.RepositorySelection == "all" {
+		return nil
+	}
+	_, err := h.github.GetRepo(ctx, token, owner, ".github")
+	if err == nil {
+		return nil
+	}
+	if status, ok := githubStatusCode(err); ok && status == http.StatusNotFound {
+		return &validationError{
+			message: fmt.Sprintf(
+				"the organization policy of %s can't be read. "+
+					"The installation of the app must include the %s/.github repository, so create it if it doesn't exist",
+				owner, owner,
+			),
+		}
+	}
+	return fmt.Errorf("failed to get the repository %s/.github: %w", owner, err)
+}
+
+// fetchPolicyFile fetches the first file that exists in paths.
+// It also returns the location of the file, such as "owner/repo/.github/actions.yaml".
+// It returns nil if none of them exists.
+func (h *Handler) fetchPolicyFile(ctx context.Context, token, owner, repo string, paths ...string) ([]byte, string, error) {
+	for _, path := range paths {
+		slog.DebugContext(ctx, "fetching "+path, slog.String("owner", owner), slog.String("repo", repo))
+		resp, err := h.github.GetReposContent(ctx, token, owner, repo, path)
+		if err == nil {
+			content, err := resp.ParseFile()
+			if err != nil {
+				return nil, "", err
+			}
+			return content, owner + "/" + repo + "/" + path, nil
+		} else if status, ok := githubStatusCode(err); !ok || status != http.StatusNotFound {
+			return nil, "", fmt.Errorf("failed to fetch %s: %w", path, err)
+		}
+		slog.DebugContext(ctx, path+" not found", slog.String("owner", owner), slog.String("repo", repo))
+	}
+	return nil, "", nil
+}
+
+// githubResolver resolves the names in the policies using GitHub API.
+type githubResolver struct {
+	github githubClient
+	token  string
+
+	mu     sync.Mutex
+	repos  map[string]uint64
+	owners map[string]uint64
+}
+
+func newGitHubResolver(github githubClient, token string) *githubResolver {
+	return &githubResolver{
+		github: github,
+		token:  token,
+		repos:  make(map[string]uint64),
+		owners: make(map[string]uint64),
+	}
+}
+
+func (r *githubResolver) repositoryID(ctx context.Context, owner, repo string) (uint64, error) {
+	key := strings.ToLower(owner + "/" + repo)
+	r.mu.Lock()
+	id, ok := r.repos[key]
+	r.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	resp, err := r.github.GetRepo(ctx, r.token, owner, repo)
+	if err != nil {
+		if status, ok := githubStatusCode(err); !ok || status != http.StatusNotFound {
+			return 0, fmt.Errorf("failed to get the repository %s/%s: %w", owner, repo, err)
+		}
+	} else {
+		id = resp.ID
+	}
+
+	r.mu.Lock()
+	r.repos[key] = id
+	r.mu.Unlock()
+	return id, nil
+}
+
+func (r *githubResolver) ownerID(ctx context.Context, owner string) (uint64, error) {
+	key := strings.ToLower(owner)
+	r.mu.Lock()
+	id, ok := r.owners[key]
+	r.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	resp, err := r.github.GetUser(ctx, r.token, owner)
+	if err != nil {
+		if status, ok := githubStatusCode(err); !ok || status != http.StatusNotFound {
+			return 0, fmt.Errorf("failed to get the owner %s: %w", owner, err)
+		}
+	} else {
+		id = resp.ID
+	}
+
+	r.mu.Lock()
+	r.owners[key] = id
+	r.mu.Unlock()
+	return id, nil
 }
 
 func (h *Handler) handleError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
@@ -3,8 +3,14 @@ package githubapptoken
 import (
 	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
 	"github.com/shogo82148/goat/jwt"
@@ -14,6 +20,7 @@ type githubClientMock struct {
 	GetAppFunc               func(ctx context.Context) (*github.GetAppResponse, error)
 	GetReposInstallationFunc func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error)
 	GetRepoFunc              func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error)
+	GetUserFunc              func(ctx context.Context, token, username string) (*github.GetUserResponse, error)
 	GetReposInfoFunc         func(ctx context.Context, token, nodeID string) (*github.GetReposInfoResponse, error)
 	GetReposContentFunc      func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error)
 	CreateAppAccessTokenFunc func(ctx context.Context, installationID uint64, permissions *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error)
@@ -34,6 +41,10 @@ func (c *githubClientMock) GetRepo(ctx context.Context, token, owner, repo strin
 	return c.GetRepoFunc(ctx, token, owner, repo)
 }
 
+func (c *githubClientMock) GetUser(ctx context.Context, token, username string) (*github.GetUserResponse, error) {
+	return c.GetUserFunc(ctx, token, username)
+}
+
 func (c *githubClientMock) GetReposInfo(ctx context.Context, token, nodeID string) (*github.GetReposInfoResponse, error) {
 	return c.GetReposInfoFunc(ctx, token, nodeID)
 }
@@ -61,7 +72,7 @@ func (c *githubClientMock) RevokeAppAccessToken(ctx context.Context, token strin
 func TestHandle_Dummy(t *testing.T) {
 	h := NewDummyHandler()
 	_, err := h.handle(context.Background(), "dummy-token", &requestBody{
-		Repositories: []string{"R_123456"},
+		Repositories: []repositoryRef{{NodeID: "R_123456"}},
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -80,8 +91,9 @@ func TestHandle(t *testing.T) {
 					Claims: &jwt.Claims{
 						Audience: []string{"https://github-app.shogo82148.com/1234567890"},
 					},
-					Repository:   "shogo82148/actions-github-app-token",
-					RepositoryID: "398574950",
+					Repository:        "shogo82148/actions-github-app-token",
+					RepositoryID:      "398574950",
+					RepositoryOwnerID: "1157344",
 				}, nil
 			},
 			GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
@@ -135,9 +147,7 @@ func TestHandle(t *testing.T) {
 		appID: 1234567890,
 	}
 	resp, err := h.handle(context.Background(), "dummy-token", &requestBody{
-		Repositories: []string{
-			"R_kgDOIeornQ", "R_kgDOIevBqQ",
-		},
+		Repositories: []repositoryRef{{NodeID: "R_kgDOIeornQ"}, {NodeID: "R_kgDOIevBqQ"}},
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -162,8 +172,9 @@ func TestHandle_NoPermission(t *testing.T) {
 					Claims: &jwt.Claims{
 						Audience: []string{"https://github-app.shogo82148.com/1234567890"},
 					},
-					Repository:   "shogo82148/actions-github-app-token",
-					RepositoryID: "398574950",
+					Repository:        "shogo82148/actions-github-app-token",
+					RepositoryID:      "398574950",
+					RepositoryOwnerID: "1157344",
 				}, nil
 			},
 			GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
@@ -217,9 +228,7 @@ func TestHandle_NoPermission(t *testing.T) {
 		appID: 1234567890,
 	}
 	_, err := h.handle(context.Background(), "dummy-token", &requestBody{
-		Repositories: []string{
-			"R_kgDOIeornQ", "R_kgDOIevBqQ",
-		},
+		Repositories: []repositoryRef{{NodeID: "R_kgDOIeornQ"}, {NodeID: "R_kgDOIevBqQ"}},
 	})
 	if err == nil {
 		t.Fatal("want some error, but not")
@@ -233,3 +242,1493 @@ func TestHandle_NoPermission(t *testing.T) {
 		t.Fatalf("want *forbiddenError, but got %T", err)
 	}
 }
+
+func TestHandle_PermissionCeiling(t *testing.T) {
+	content := "repositories:\n" +
+		"  - repository: R_kgDOF8HFZg\n" +
+		"    permissions:\n" +
+		"      contents: write\n" +
+		"      issues: read\n"
+
+	cases := []struct {
+		name      string
+		installed map[string]string
+		requested *permissions
+		want      *github.CreateAppAccessTokenRequestPermissions
+		wantErr   bool
+	}{
+		{
+			name:      "clamp",
+			requested: nil,
+			want: &github.CreateAppAccessTokenRequestPermissions{
+				Contents: "write",
+				Issues:   "read",
+			},
+		},
+		{
+			name: "within the ceiling",
+			requested: &permissions{
+				Contents: "read",
+			},
+			want: &github.CreateAppAccessTokenRequestPermissions{
+				Contents: "read",
+			},
+		},
+		{
+			name: "over the ceiling",
+			requested: &permissions{
+				Issues: "write",
+			},
+			wantErr: true,
+		},
+		{
+			// the action sends the empty permissions if no permission-* inputs are set.
+			name:      "empty",
+			requested: &permissions{},
+			want: &github.CreateAppAccessTokenRequestPermissions{
+				Contents: "write",
+				Issues:   "read",
+			},
+		},
+		{
+			// GitHub rejects the permissions that the installation doesn't have.
+			name:      "the installation without issues",
+			installed: map[string]string{"contents": "write", "metadata": "read"},
+			requested: nil,
+			want: &github.CreateAppAccessTokenRequestPermissions{
+				Contents: "write",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got *github.CreateAppAccessTokenRequestPermissions
+			h := &Handler{
+				github: &githubClientMock{
+					ValidateAPIURLFunc: func(url string) error {
+						return nil
+					},
+					ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+						return &github.ActionsIDToken{
+							Claims: &jwt.Claims{
+								Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+							},
+							Repository:        "shogo82148/actions-github-app-token",
+							RepositoryID:      "398574950",
+							RepositoryOwnerID: "1157344",
+						}, nil
+					},
+					GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+						return &github.GetRepoResponse{
+							ID:     398574950,
+							NodeID: "R_kgDOF8HFZg",
+						}, nil
+					},
+					GetReposInfoFunc: func(ctx context.Context, token, nodeID string) (*github.GetReposInfoResponse, error) {
+						return &github.GetReposInfoResponse{
+							ID:    577123456,
+							Owner: "shogo82148",
+							Name:  "docs",
+						}, nil
+					},
+					GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+						return &github.GetReposContentResponse{
+							Type:     "file",
+							Encoding: "base64",
+							Content:  base64.StdEncoding.EncodeToString([]byte(content)),
+						}, nil
+					},
+					GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+						return &github.GetReposInstallationResponse{
+							ID:          641323,
+							Permissions: c.installed,
+						}, nil
+					},
+					CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+						if len(req.RepositoryIDs) > 0 {
+							got = req.Permissions
+						}
+						return &github.CreateAppAccessTokenResponse{
+							Token: "ghs_dummyGitHubToken",
+						}, nil
+					},
+					RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+						return nil
+					},
+				},
+				appID: 1234567890,
+			}
+			_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+				Repositories: []repositoryRef{{NodeID: "R_kgDOIeornQ"}},
+				Permissions:  c.requested,
+			})
+			if c.wantErr {
+				var forbidden *forbiddenError
+				if !errors.As(err, &forbidden) {
+					t.Fatalf("want *forbiddenError, but got %T", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("unexpected permissions: want %#v, got %#v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestHandle_OrgPolicy(t *testing.T) {
+	var got *github.CreateAppAccessTokenRequestPermissions
+	h := &Handler{
+		github: &githubClientMock{
+			ValidateAPIURLFunc: func(url string) error {
+				return nil
+			},
+			ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+				return &github.ActionsIDToken{
+					Claims: &jwt.Claims{
+						Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+					},
+					Repository:        "shogo82148/actions-github-app-token",
+					RepositoryID:      "398574950",
+					RepositoryOwnerID: "1157344",
+				}, nil
+			},
+			GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+				return &github.GetRepoResponse{
+					ID:     398574950,
+					NodeID: "R_kgDOF8HFZg",
+				}, nil
+			},
+			GetUserFunc: func(ctx context.Context, token, username string) (*github.GetUserResponse, error) {
+				if username != "shogo82148" {
+					t.Errorf("unexpected username: got %q, want %q", username, "shogo82148")
+				}
+				return &github.GetUserResponse{
+					Login: "shogo82148",
+					ID:    1157344,
+				}, nil
+			},
+			GetReposInfoFunc: func(ctx context.Context, token, nodeID string) (*github.GetReposInfoResponse, error) {
+				return &github.GetReposInfoResponse{
+					ID:    577123456,
+					Owner: "shogo82148",
+					Name:  "docs",
+				}, nil
+			},
+			GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+				if repo != ".github" || path != ".github/org-actions.yaml" {
+					return nil, &github.UnexpectedStatusCodeError{
+						StatusCode: http.StatusNotFound,
+					}
+				}
+				content := "repositories:\n" +
+					"  - repository: shogo82148/*\n" +
+					"    permissions:\n" +
+					"      contents: read\n"
+				return &github.GetReposContentResponse{
+					Type:     "file",
+					Encoding: "base64",
+					Content:  base64.StdEncoding.EncodeToString([]byte(content)),
+				}, nil
+			},
+			GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+				return &github.GetReposInstallationResponse{
+					ID: 641323,
+				}, nil
+			},
+			CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+				if len(req.RepositoryIDs) > 0 {
+					got = req.Permissions
+				}
+				return &github.CreateAppAccessTokenResponse{
+					Token: "ghs_dummyGitHubToken",
+				}, nil
+			},
+			RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+				return nil
+			},
+		},
+		appID: 1234567890,
+	}
+	_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+		Repositories: []repositoryRef{{NodeID: "R_kgDOIeornQ"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &github.CreateAppAccessTokenRequestPermissions{
+		Contents: "read",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected permissions: want %#v, got %#v", want, got)
+	}
+}
+
+func TestHandle_OrgPolicyNotVisible(t *testing.T) {
+	content := "repositories:\n" +
+		"  - repository: R_kgDOF8HFZg\n" +
+		"    permissions:\n" +
+		"      contents: read\n"
+
+	cases := []struct {
+		name      string
+		selection string
+		visible   bool
+		wantErr   bool
+	}{
+		{
+			// the deny rules in the hidden organization policy must not be skipped.
+			name:      "hidden from the installation",
+			selection: "selected",
+			visible:   false,
+			wantErr:   true,
+		},
+		{
+			name:      "the repository without the organization policy",
+			selection: "selected",
+			visible:   true,
+		},
+		{
+			// the installation for all repositories can see the repository if it exists.
+			name:      "all repositories",
+			selection: "all",
+			visible:   false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := &Handler{
+				github: &githubClientMock{
+					ValidateAPIURLFunc: func(url string) error {
+						return nil
+					},
+					ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+						return &github.ActionsIDToken{
+							Claims: &jwt.Claims{
+								Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+							},
+							Repository:        "shogo82148/actions-github-app-token",
+							RepositoryID:      "398574950",
+							RepositoryOwnerID: "1157344",
+						}, nil
+					},
+					GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+						if repo == ".github" {
+							if c.selection == "all" {
+								t.Error("the repository is checked for the installation for all repositories")
+							}
+							if !c.visible {
+								return nil, &github.UnexpectedStatusCodeError{
+									StatusCode: http.StatusNotFound,
+								}
+							}
+							return &github.GetRepoResponse{
+								ID:       577654321,
+								FullName: "shogo82148/.github",
+							}, nil
+						}
+						return &github.GetRepoResponse{
+							ID:     398574950,
+							NodeID: "R_kgDOF8HFZg",
+						}, nil
+					},
+					GetReposInfoFunc: func(ctx context.Context, token, nodeID string) (*github.GetReposInfoResponse, error) {
+						return &github.GetReposInfoResponse{
+							ID:    577123456,
+							Owner: "shogo82148",
+							Name:  "docs",
+						}, nil
+					},
+					GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+						if repo != "docs" || path != ".github/actions.yaml" {
+							return nil, &github.UnexpectedStatusCodeError{
+								StatusCode: http.StatusNotFound,
+							}
+						}
+						return &github.GetReposContentResponse{
+							Type:     "file",
+							Encoding: "base64",
+							Content:  base64.StdEncoding.EncodeToString([]byte(content)),
+						}, nil
+					},
+					GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+						return &github.GetReposInstallationResponse{
+							ID:                  641323,
+							RepositorySelection: c.selection,
+						}, nil
+					},
+					CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+						return &github.CreateAppAccessTokenResponse{
+							Token: "ghs_dummyGitHubToken",
+						}, nil
+					},
+					RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+						return nil
+					},
+				},
+				appID: 1234567890,
+			}
+			_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+				Repositories: []repositoryRef{{NodeID: "R_kgDOIeornQ"}},
+			})
+			if c.wantErr {
+				var validation *validationError
+				if !errors.As(err, &validation) {
+					t.Errorf("want validation error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestHandle_SelfPolicy(t *testing.T) {
+	content := "self:\n" +
+		"  - permissions:\n" +
+		"      contents: write\n" +
+		"  - ref: refs/heads/main\n" +
+		"    event_name: \"!pull_request\"\n" +
+		"    permissions:\n" +
+		"      administration: write\n"
+
+	cases := []struct {
+		name    string
+		ref     string
+		wantErr bool
+	}{
+		{
+			name:    "main branch",
+			ref:     "refs/heads/main",
+			wantErr: false,
+		},
+		{
+			name:    "feature branch",
+			ref:     "refs/heads/feature",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := &Handler{
+				github: &githubClientMock{
+					ValidateAPIURLFunc: func(url string) error {
+						return nil
+					},
+					ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+						return &github.ActionsIDToken{
+							Claims: &jwt.Claims{
+								Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+							},
+							Repository:        "shogo82148/actions-github-app-token",
+							RepositoryID:      "398574950",
+							RepositoryOwnerID: "1157344",
+							Ref:               c.ref,
+							EventName:         "push",
+						}, nil
+					},
+					GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+						return &github.GetRepoResponse{
+							ID:     398574950,
+							NodeID: "R_kgDOF8HFZg",
+						}, nil
+					},
+					GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+						if owner != "shogo82148" || repo != "actions-github-app-token" {
+							t.Errorf("unexpected repository: %s/%s", owner, repo)
+						}
+						return &github.GetReposContentResponse{
+							Type:     "file",
+							Encoding: "base64",
+							Content:  base64.StdEncoding.EncodeToString([]byte(content)),
+						}, nil
+					},
+					GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+						return &github.GetReposInstallationResponse{
+							ID: 641323,
+						}, nil
+					},
+					CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+						return &github.CreateAppAccessTokenResponse{
+							Token: "ghs_dummyGitHubToken",
+						}, nil
+					},
+					RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+						return nil
+					},
+				},
+				appID: 1234567890,
+			}
+			_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+				Permissions: &permissions{
+					Administration: "write",
+				},
+			})
+			if c.wantErr {
+				var forbidden *forbiddenError
+				if !errors.As(err, &forbidden) {
+					t.Fatalf("want *forbiddenError, but got %T", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestHandle_InvalidCondition(t *testing.T) {
+	h := &Handler{
+		github: &githubClientMock{
+			ValidateAPIURLFunc: func(url string) error {
+				return nil
+			},
+			ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+				return &github.ActionsIDToken{
+					Claims: &jwt.Claims{
+						Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+					},
+					Repository:        "shogo82148/actions-github-app-token",
+					RepositoryID:      "398574950",
+					RepositoryOwnerID: "1157344",
+				}, nil
+			},
+			GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+				return &github.GetRepoResponse{
+					ID:     398574950,
+					NodeID: "R_kgDOF8HFZg",
+				}, nil
+			},
+			GetReposInfoFunc: func(ctx context.Context, token, nodeID string) (*github.GetReposInfoResponse, error) {
+				return &github.GetReposInfoResponse{
+					ID:    577123456,
+					Owner: "shogo82148",
+					Name:  "docs",
+				}, nil
+			},
+			GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+				if repo != "docs" || path != ".github/actions.yaml" {
+					return nil, &github.UnexpectedStatusCodeError{
+						StatusCode: http.StatusNotFound,
+					}
+				}
+				content := "repositories:\n" +
+					"  - repository: R_kgDOF8HFZg\n" +
+					"    condition: claims.actor ==\n"
+				return &github.GetReposContentResponse{
+					Type:     "file",
+					Encoding: "base64",
+					Content:  base64.StdEncoding.EncodeToString([]byte(content)),
+				}, nil
+			},
+			GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+				return &github.GetReposInstallationResponse{
+					ID: 641323,
+				}, nil
+			},
+			CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+				return &github.CreateAppAccessTokenResponse{
+					Token: "ghs_dummyGitHubToken",
+				}, nil
+			},
+			RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+				return nil
+			},
+		},
+		appID: 1234567890,
+	}
+	_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+		Repositories: []repositoryRef{{NodeID: "R_kgDOIeornQ"}},
+	})
+	var validation *validationError
+	if !errors.As(err, &validation) {
+		t.Fatalf("want *validationError, but got %T", err)
+	}
+	var forbidden *forbiddenError
+	if errors.As(err, &forbidden) {
+		t.Errorf("want no *forbiddenError, but got it")
+	}
+}
+
+func TestHandle_DryRun(t *testing.T) {
+	h := &Handler{
+		github: &githubClientMock{
+			ValidateAPIURLFunc: func(url string) error {
+				return nil
+			},
+			ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+				return &github.ActionsIDToken{
+					Claims: &jwt.Claims{
+						Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+					},
+					Repository:        "shogo82148/actions-github-app-token",
+					RepositoryID:      "398574950",
+					RepositoryOwnerID: "1157344",
+					Ref:               "refs/heads/feature",
+				}, nil
+			},
+			GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+				return &github.GetRepoResponse{
+					ID:     398574950,
+					NodeID: "R_kgDOF8HFZg",
+				}, nil
+			},
+			GetReposInfoFunc: func(ctx context.Context, token, nodeID string) (*github.GetReposInfoResponse, error) {
+				switch nodeID {
+				case "R_kgDOIeornQ":
+					return &github.GetReposInfoResponse{
+						ID:    577123456,
+						Owner: "shogo82148",
+						Name:  "docs",
+					}, nil
+				case "R_kgDOJ4y6Dw":
+					return &github.GetReposInfoResponse{
+						ID:    577123457,
+						Owner: "shogo82148",
+						Name:  "private",
+					}, nil
+				}
+				t.Errorf("unexpected node id: %q", nodeID)
+				return nil, &github.UnexpectedStatusCodeError{
+					StatusCode: http.StatusNotFound,
+				}
+			},
+			GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+				if repo != "docs" || path != ".github/actions.yaml" {
+					return nil, &github.UnexpectedStatusCodeError{
+						StatusCode: http.StatusNotFound,
+					}
+				}
+				content := "repositories:\n" +
+					"  - repository: shogo82148/actions-github-app-token\n" +
+					"    ref: refs/heads/main\n" +
+					"    permissions:\n" +
+					"      contents: write\n" +
+					"  - repository: shogo82148/actions-github-app-token\n" +
+					"    permissions:\n" +
+					"      contents: read\n"
+				return &github.GetReposContentResponse{
+					Type:     "file",
+					Encoding: "base64",
+					Content:  base64.StdEncoding.EncodeToString([]byte(content)),
+				}, nil
+			},
+			GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+				return &github.GetReposInstallationResponse{
+					ID: 641323,
+				}, nil
+			},
+			CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+				if len(req.RepositoryIDs) > 0 {
+					t.Error("the dry run must not issue the token")
+				}
+				return &github.CreateAppAccessTokenResponse{
+					Token: "ghs_dummyGitHubToken",
+				}, nil
+			},
+			RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+				return nil
+			},
+		},
+		appID: 1234567890,
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		resp, err := h.handle(context.Background(), "dummy-token", &requestBody{
+			Repositories: []repositoryRef{{NodeID: "R_kgDOIeornQ"}},
+			DryRun:       true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.GitHubToken != "" {
+			t.Errorf("unexpected token: %q", resp.GitHubToken)
+		}
+		want := &dryRunResult{
+			Allowed:     true,
+			Permissions: permissionSet{"contents": "read"},
+			Self: &repositoryDecision{
+				Repository: "shogo82148/actions-github-app-token",
+				Allowed:    true,
+				Rules:      []*ruleDecision{},
+			},
+			Repositories: []*repositoryDecision{
+				{
+					Repository:  "R_kgDOIeornQ",
+					Allowed:     true,
+					Permissions: permissionSet{"contents": "read"},
+					Rules: []*ruleDecision{
+						{
+							Policy:      "shogo82148/docs/.github/actions.yaml",
+							Rule:        "repositories[0]",
+							Matched:     false,
+							Reason:      `ref "refs/heads/feature" doesn't match`,
+							Permissions: permissionSet{"contents": "write"},
+						},
+						{
+							Policy:      "shogo82148/docs/.github/actions.yaml",
+							Rule:        "repositories[1]",
+							Matched:     true,
+							Permissions: permissionSet{"contents": "read"},
+						},
+					},
+				},
+			},
+		}
+		if !reflect.DeepEqual(resp.DryRun, want) {
+			t.Errorf("unexpected result: want %#v, got %#v", want, resp.DryRun)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		resp, err := h.handle(context.Background(), "dummy-token", &requestBody{
+			Repositories: []repositoryRef{{NodeID: "R_kgDOIeornQ"}, {NodeID: "R_kgDOJ4y6Dw"}},
+			Permissions: &permissions{
+				Contents: "read",
+			},
+			DryRun: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := resp.DryRun
+		if got.Allowed {
+			t.Error("want denied, got allowed")
+		}
+		if got.Error != "permission denied for R_kgDOJ4y6Dw" {
+			t.Errorf("unexpected error: %q", got.Error)
+		}
+		if len(got.Repositories) != 2 {
+			t.Fatalf("unexpected repositories: %#v", got.Repositories)
+		}
+		if !got.Repositories[0].Allowed {
+			t.Errorf("want R_kgDOIeornQ allowed, got %q", got.Repositories[0].Error)
+		}
+		if d := got.Repositories[1]; d.Allowed || d.Error != "config file is not found" {
+			t.Errorf("unexpected decision for R_kgDOJ4y6Dw: %#v", d)
+		}
+	})
+
+	t.Run("over the ceiling", func(t *testing.T) {
+		resp, err := h.handle(context.Background(), "dummy-token", &requestBody{
+			Repositories: []repositoryRef{{NodeID: "R_kgDOIeornQ"}},
+			Permissions: &permissions{
+				Contents: "write",
+			},
+			DryRun: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := resp.DryRun
+		if got.Allowed {
+			t.Error("want denied, got allowed")
+		}
+		if got.Error != "contents: write is not allowed, up to read" {
+			t.Errorf("unexpected error: %q", got.Error)
+		}
+	})
+}
+
+func TestHandle_OperatorPolicy(t *testing.T) {
+	policy := &operatorPolicy{
+		Owners: []string{"shogo82148"},
+		Deny:   []string{"shogo82148/secret-*"},
+		Permissions: map[string]permissionSet{
+			"shogo82148": {"contents": "write", "administration": "write", "metadata": "read"},
+		},
+		BannedPermissions: []string{"administration"},
+	}
+	cases := []struct {
+		name        string
+		repository  string
+		permissions *permissions
+		want        *github.CreateAppAccessTokenRequestPermissions
+		forbidden   bool
+	}{
+		{
+			name:       "default permissions without banned ones",
+			repository: "shogo82148/actions-github-app-token",
+			want: &github.CreateAppAccessTokenRequestPermissions{
+				Contents: "write",
+				Metadata: "read",
+			},
+		},
+		{
+			name:       "requested permissions",
+			repository: "shogo82148/actions-github-app-token",
+			permissions: &permissions{
+				Contents: "read",
+			},
+			want: &github.CreateAppAccessTokenRequestPermissions{
+				Contents: "read",
+			},
+		},
+		{
+			name:        "empty permissions",
+			repository:  "shogo82148/actions-github-app-token",
+			permissions: &permissions{},
+			want: &github.CreateAppAccessTokenRequestPermissions{
+				Contents: "write",
+				Metadata: "read",
+			},
+		},
+		{
+			name:       "banned permissions",
+			repository: "shogo82148/actions-github-app-token",
+			permissions: &permissions{
+				Administration: "read",
+			},
+			forbidden: true,
+		},
+		{
+			name:       "owner not in the allowlist",
+			repository: "octocat/hello-world",
+			forbidden:  true,
+		},
+		{
+			name:       "denied repository",
+			repository: "shogo82148/secret-repo",
+			forbidden:  true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got *github.CreateAppAccessTokenRequestPermissions
+			h := &Handler{
+				github: &githubClientMock{
+					ValidateAPIURLFunc: func(url string) error {
+						return nil
+					},
+					ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+						return &github.ActionsIDToken{
+							Claims: &jwt.Claims{
+								Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+							},
+							Repository:        c.repository,
+							RepositoryID:      "398574950",
+							RepositoryOwnerID: "1157344",
+						}, nil
+					},
+					GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+						return &github.GetRepoResponse{
+							ID:     398574950,
+							NodeID: "R_kgDOF8HFZg",
+						}, nil
+					},
+					GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+						return nil, &github.UnexpectedStatusCodeError{
+							StatusCode: http.StatusNotFound,
+						}
+					},
+					GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+						return &github.GetReposInstallationResponse{
+							ID: 641323,
+							Permissions: map[string]string{
+								"administration": "write",
+								"contents":       "write",
+								"issues":         "write",
+								"metadata":       "read",
+							},
+						}, nil
+					},
+					CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+						if len(req.RepositoryIDs) > 0 {
+							got = req.Permissions
+						}
+						return &github.CreateAppAccessTokenResponse{
+							Token: "ghs_dummyGitHubToken",
+						}, nil
+					},
+					RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+						return nil
+					},
+				},
+				appID:  1234567890,
+				policy: policy,
+			}
+			_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+				Permissions: c.permissions,
+			})
+			if c.forbidden {
+				var forbidden *forbiddenError
+				if !errors.As(err, &forbidden) {
+					t.Errorf("want forbidden error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("unexpected permissions: want %#v, got %#v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestClampPermissions(t *testing.T) {
+	cases := []struct {
+		name      string
+		ceiling   permissionSet
+		installed permissionSet
+		requested *permissions
+		want      *permissions
+		wantErr   bool
+	}{
+		{
+			name:      "no ceiling",
+			ceiling:   nil,
+			requested: &permissions{},
+			want:      &permissions{},
+		},
+		{
+			name:      "no request",
+			ceiling:   permissionSet{"contents": "read"},
+			requested: nil,
+			want:      &permissions{Contents: "read"},
+		},
+		{
+			name:      "empty request",
+			ceiling:   permissionSet{"contents": "read"},
+			requested: &permissions{},
+			want:      &permissions{Contents: "read"},
+		},
+		{
+			// GitHub rejects the permissions that the installation doesn't have.
+			name:      "no request and the installation without some of the ceiling",
+			ceiling:   permissionSet{"contents": "write", "issues": "write"},
+			installed: permissionSet{"contents": "read", "metadata": "read"},
+			requested: nil,
+			want:      &permissions{Contents: "read"},
+		},
+		{
+			name:      "no request and the installation without any of the ceiling",
+			ceiling:   permissionSet{"issues": "write"},
+			installed: permissionSet{"contents": "read", "metadata": "read"},
+			requested: nil,
+			wantErr:   true,
+		},
+		{
+			// such as the intersection of "contents: read" and "issues: write".
+			name:      "empty ceiling",
+			ceiling:   permissionSet{},
+			requested: nil,
+			wantErr:   true,
+		},
+		{
+			name:      "empty ceiling and empty request",
+			ceiling:   permissionSet{},
+			requested: &permissions{},
+			wantErr:   true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := clampPermissions(c.ceiling, c.installed, c.requested)
+			if c.wantErr {
+				var forbidden *forbiddenError
+				if !errors.As(err, &forbidden) {
+					t.Errorf("want forbidden error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("want %#v, got %#v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestRequestBody_Repositories(t *testing.T) {
+	var body requestBody
+	data := `{"repositories": [
+		"R_kgDOIeornQ",
+		"shogo82148/docs",
+		{"node_id": "R_kgDOIevBqQ"},
+		{"repository": "shogo82148/actions-github-app-token"}
+	]}`
+	if err := json.Unmarshal([]byte(data), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := []repositoryRef{
+		{NodeID: "R_kgDOIeornQ"},
+		{Repository: "shogo82148/docs"},
+		{NodeID: "R_kgDOIevBqQ"},
+		{Repository: "shogo82148/actions-github-app-token"},
+	}
+	if !reflect.DeepEqual(body.Repositories, want) {
+		t.Errorf("unexpected repositories: want %#v, got %#v", want, body.Repositories)
+	}
+
+	data = `{"repositories": [{"node_id": "R_kgDOIevBqQ", "repository": "shogo82148/docs"}]}`
+	if err := json.Unmarshal([]byte(data), &body); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestHandle_RepositoryName(t *testing.T) {
+	var got []uint64
+	h := &Handler{
+		github: &githubClientMock{
+			ValidateAPIURLFunc: func(url string) error {
+				return nil
+			},
+			ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+				return &github.ActionsIDToken{
+					Claims: &jwt.Claims{
+						Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+					},
+					Repository:        "shogo82148/actions-github-app-token",
+					RepositoryID:      "398574950",
+					RepositoryOwnerID: "1157344",
+				}, nil
+			},
+			GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+				switch owner + "/" + repo {
+				case "shogo82148/actions-github-app-token":
+					return &github.GetRepoResponse{
+						ID:       398574950,
+						NodeID:   "R_kgDOF8HFZg",
+						FullName: "shogo82148/actions-github-app-token",
+					}, nil
+				case "Shogo82148/Docs":
+					return &github.GetRepoResponse{
+						ID:       577123456,
+						NodeID:   "R_kgDOIeornQ",
+						FullName: "shogo82148/docs",
+					}, nil
+				}
+				return nil, &github.UnexpectedStatusCodeError{
+					StatusCode: http.StatusNotFound,
+				}
+			},
+			GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+				if owner != "shogo82148" || repo != "docs" || path != ".github/actions.yaml" {
+					return nil, &github.UnexpectedStatusCodeError{
+						StatusCode: http.StatusNotFound,
+					}
+				}
+				content := "repositories:\n  - R_kgDOF8HFZg\n"
+				return &github.GetReposContentResponse{
+					Type:     "file",
+					Encoding: "base64",
+					Content:  base64.StdEncoding.EncodeToString([]byte(content)),
+				}, nil
+			},
+			GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+				return &github.GetReposInstallationResponse{
+					ID:                  641323,
+					RepositorySelection: "all",
+				}, nil
+			},
+			CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+				if len(req.RepositoryIDs) > 0 {
+					got = req.RepositoryIDs
+				}
+				return &github.CreateAppAccessTokenResponse{
+					Token: "ghs_dummyGitHubToken",
+				}, nil
+			},
+			RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+				return nil
+			},
+		},
+		appID: 1234567890,
+	}
+
+	_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+		Repositories: []repositoryRef{{Repository: "Shogo82148/Docs"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{398574950, 577123456}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected repository ids: want %v, got %v", want, got)
+	}
+
+	// the repository that the app can't access.
+	_, err = h.handle(context.Background(), "dummy-token", &requestBody{
+		Repositories: []repositoryRef{{Repository: "shogo82148/unknown"}},
+	})
+	var forbidden *forbiddenError
+	if !errors.As(err, &forbidden) {
+		t.Errorf("want forbidden error, got %v", err)
+	}
+}
+
+func TestHandle_OrganizationScope(t *testing.T) {
+	orgPolicy := "organization:\n" +
+		"  - repository: shogo82148/actions-github-app-token\n" +
+		"    permissions:\n" +
+		"      members: read\n" +
+		"      organization_secrets: write\n"
+	selfPolicy := ""
+
+	var got *github.CreateAppAccessTokenRequest
+	h := &Handler{
+		github: &githubClientMock{
+			ValidateAPIURLFunc: func(url string) error {
+				return nil
+			},
+			ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+				return &github.ActionsIDToken{
+					Claims: &jwt.Claims{
+						Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+					},
+					Repository:        "shogo82148/actions-github-app-token",
+					RepositoryID:      "398574950",
+					RepositoryOwnerID: "1157344",
+				}, nil
+			},
+			GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+				return &github.GetRepoResponse{
+					ID:       398574950,
+					NodeID:   "R_kgDOF8HFZg",
+					FullName: "shogo82148/actions-github-app-token",
+				}, nil
+			},
+			GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+				content := ""
+				switch {
+				case repo == ".github" && path == ".github/org-actions.yaml":
+					content = orgPolicy
+				case repo == "actions-github-app-token" && path == ".github/actions.yaml":
+					content = selfPolicy
+				}
+				if content == "" {
+					return nil, &github.UnexpectedStatusCodeError{
+						StatusCode: http.StatusNotFound,
+					}
+				}
+				return &github.GetReposContentResponse{
+					Type:     "file",
+					Encoding: "base64",
+					Content:  base64.StdEncoding.EncodeToString([]byte(content)),
+				}, nil
+			},
+			GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+				return &github.GetReposInstallationResponse{
+					ID: 641323,
+				}, nil
+			},
+			CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+				if req.Permissions == nil || req.Permissions.SingleFile != "read" {
+					got = req
+				}
+				return &github.CreateAppAccessTokenResponse{
+					Token: "ghs_dummyGitHubToken",
+				}, nil
+			},
+			RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+				return nil
+			},
+		},
+		appID: 1234567890,
+	}
+
+	t.Run("allowed", func(t *testing.T) {
+		got = nil
+		_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+			Scope: "organization",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &github.CreateAppAccessTokenRequest{
+			Permissions: &github.CreateAppAccessTokenRequestPermissions{
+				Members:             "read",
+				OrganizationSecrets: "write",
+			},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected request: want %#v, got %#v", want, got)
+		}
+	})
+
+	t.Run("over the ceiling", func(t *testing.T) {
+		_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+			Scope: "organization",
+			Permissions: &permissions{
+				OrganizationAdministration: "write",
+			},
+		})
+		var forbidden *forbiddenError
+		if !errors.As(err, &forbidden) {
+			t.Errorf("want forbidden error, got %v", err)
+		}
+	})
+
+	t.Run("with repositories", func(t *testing.T) {
+		_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+			Scope:        "organization",
+			Repositories: []repositoryRef{{NodeID: "R_kgDOIeornQ"}},
+		})
+		var validation *validationError
+		if !errors.As(err, &validation) {
+			t.Errorf("want validation error, got %v", err)
+		}
+	})
+
+	t.Run("self rules", func(t *testing.T) {
+		// the token can access the repository itself, so its self rules apply too.
+		selfPolicy = "self:\n" +
+			"  - permissions:\n" +
+			"      members: read\n"
+		defer func() { selfPolicy = "" }()
+		got = nil
+		_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+			Scope: "organization",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &github.CreateAppAccessTokenRequest{
+			Permissions: &github.CreateAppAccessTokenRequestPermissions{
+				Members: "read",
+			},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected request: want %#v, got %#v", want, got)
+		}
+
+		_, err = h.handle(context.Background(), "dummy-token", &requestBody{
+			Scope: "organization",
+			Permissions: &permissions{
+				OrganizationSecrets: "write",
+			},
+		})
+		var forbidden *forbiddenError
+		if !errors.As(err, &forbidden) {
+			t.Errorf("want forbidden error, got %v", err)
+		}
+	})
+
+	t.Run("denied by the operator", func(t *testing.T) {
+		h.policy = &operatorPolicy{
+			Deny: []string{"shogo82148/secret-*"},
+		}
+		defer func() { h.policy = nil }()
+		_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+			Scope: "organization",
+		})
+		var forbidden *forbiddenError
+		if !errors.As(err, &forbidden) {
+			t.Errorf("want forbidden error, got %v", err)
+		}
+	})
+
+	t.Run("no organization rules", func(t *testing.T) {
+		orgPolicy = "repositories:\n  - shogo82148/*\n"
+		defer func() { orgPolicy = "" }()
+		_, err := h.handle(context.Background(), "dummy-token", &requestBody{
+			Scope: "organization",
+		})
+		var forbidden *forbiddenError
+		if !errors.As(err, &forbidden) {
+			t.Errorf("want forbidden error, got %v", err)
+		}
+	})
+}
+
+func TestHandle_CrossInstallation(t *testing.T) {
+	var revoked []string
+	failOn := uint64(0)
+	h := &Handler{
+		github: &githubClientMock{
+			ValidateAPIURLFunc: func(url string) error {
+				return nil
+			},
+			ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+				return &github.ActionsIDToken{
+					Claims: &jwt.Claims{
+						Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+					},
+					Repository:        "shogo82148/actions-github-app-token",
+					RepositoryID:      "398574950",
+					RepositoryOwnerID: "1157344",
+				}, nil
+			},
+			GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+				switch {
+				case owner+"/"+repo == "shogo82148/actions-github-app-token" && token == "ghs_policy_641323":
+					return &github.GetRepoResponse{
+						ID:       398574950,
+						NodeID:   "R_kgDOF8HFZg",
+						FullName: "shogo82148/actions-github-app-token",
+					}, nil
+				case owner+"/"+repo == "fuller-inc/actions" && token == "ghs_policy_721503":
+					// the repository of the other installation is read with its own token.
+					return &github.GetRepoResponse{
+						ID:       402178347,
+						NodeID:   "R_kgDOF_iCKw",
+						FullName: "fuller-inc/actions",
+					}, nil
+				}
+				return nil, &github.UnexpectedStatusCodeError{
+					StatusCode: http.StatusNotFound,
+				}
+			},
+			GetReposInfoFunc: func(ctx context.Context, token, nodeID string) (*github.GetReposInfoResponse, error) {
+				// the public repository of the other installation is visible from the installation of the caller.
+				if nodeID == "R_kgDOF_iCKw" && (token == "ghs_policy_641323" || token == "ghs_policy_721503") {
+					return &github.GetReposInfoResponse{
+						ID:    402178347,
+						Owner: "fuller-inc",
+						Name:  "actions",
+					}, nil
+				}
+				// GitHub responds null for the invisible nodes.
+				return &github.GetReposInfoResponse{}, nil
+			},
+			GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+				if owner != "fuller-inc" || repo != "actions" || path != ".github/actions.yaml" || token != "ghs_policy_721503" {
+					return nil, &github.UnexpectedStatusCodeError{
+						StatusCode: http.StatusNotFound,
+					}
+				}
+				content := "repositories:\n" +
+					"  - repository: R_kgDOF8HFZg\n" +
+					"    permissions:\n" +
+					"      contents: read\n"
+				return &github.GetReposContentResponse{
+					Type:     "file",
+					Encoding: "base64",
+					Content:  base64.StdEncoding.EncodeToString([]byte(content)),
+				}, nil
+			},
+			GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+				switch owner {
+				case "shogo82148":
+					return &github.GetReposInstallationResponse{
+						ID:                  641323,
+						RepositorySelection: "all",
+					}, nil
+				case "fuller-inc":
+					return &github.GetReposInstallationResponse{
+						ID:                  721503,
+						RepositorySelection: "all",
+						Account: &github.GetReposInstallationResponseAccount{
+							Login: "Fuller-Inc",
+							ID:    2048214,
+						},
+					}, nil
+				}
+				return nil, &github.UnexpectedStatusCodeError{
+					StatusCode: http.StatusNotFound,
+				}
+			},
+			CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+				if req.Permissions != nil && req.Permissions.SingleFile == "read" {
+					return &github.CreateAppAccessTokenResponse{
+						Token: fmt.Sprintf("ghs_policy_%d", installationID),
+					}, nil
+				}
+				if installationID == failOn {
+					return nil, &github.UnexpectedStatusCodeError{
+						StatusCode: http.StatusInternalServerError,
+					}
+				}
+				if installationID == 721503 && (!reflect.DeepEqual(req.RepositoryIDs, []uint64{402178347}) || req.Permissions.Contents != "read") {
+					t.Errorf("unexpected request for the installation %d: %#v", installationID, req)
+				}
+				return &github.CreateAppAccessTokenResponse{
+					Token:               fmt.Sprintf("ghs_token_%d", installationID),
+					ExpiresAt:           time.Date(2026, 10, 17, 13, 0, 0, 0, time.UTC),
+					Permissions:         map[string]string{"contents": "read"},
+					RepositorySelection: "selected",
+				}, nil
+			},
+			RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+				revoked = append(revoked, token)
+				return nil
+			},
+		},
+		appID: 1234567890,
+	}
+
+	resp, err := h.handle(context.Background(), "dummy-token", &requestBody{
+		Repositories: []repositoryRef{{Repository: "fuller-inc/actions"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiresAt := time.Date(2026, 10, 17, 13, 0, 0, 0, time.UTC)
+	want := []*installationToken{
+		{
+			GitHubToken:         "ghs_token_641323",
+			ExpiresAt:           expiresAt,
+			Permissions:         map[string]string{"contents": "read"},
+			RepositorySelection: "selected",
+			InstallationID:      641323,
+			Account:             "shogo82148",
+		},
+		{
+			GitHubToken:         "ghs_token_721503",
+			ExpiresAt:           expiresAt,
+			Permissions:         map[string]string{"contents": "read"},
+			RepositorySelection: "selected",
+			InstallationID:      721503,
+			Account:             "Fuller-Inc",
+		},
+	}
+	if !reflect.DeepEqual(resp.Tokens, want) {
+		t.Errorf("unexpected tokens: want %#v, got %#v", want, resp.Tokens)
+	}
+	if !reflect.DeepEqual(resp.installationToken, *want[0]) {
+		t.Errorf("unexpected token: want %#v, got %#v", want[0], resp.installationToken)
+	}
+
+	// the node id is resolved into the owner, and then into the installation.
+	resp, err = h.handle(context.Background(), "dummy-token", &requestBody{
+		Repositories: []repositoryRef{{NodeID: "R_kgDOF_iCKw"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp.Tokens, want) {
+		t.Errorf("unexpected tokens: want %#v, got %#v", want, resp.Tokens)
+	}
+
+	// the node id that the installation of the caller can't see.
+	_, err = h.handle(context.Background(), "dummy-token", &requestBody{
+		Repositories: []repositoryRef{{NodeID: "R_kgDOHidden"}},
+	})
+	var validation *validationError
+	if !errors.As(err, &validation) {
+		t.Errorf("want validation error, got %v", err)
+	}
+
+	// the app is not installed in the owner.
+	_, err = h.handle(context.Background(), "dummy-token", &requestBody{
+		Repositories: []repositoryRef{{Repository: "octocat/hello-world"}},
+	})
+	var forbidden *forbiddenError
+	if !errors.As(err, &forbidden) {
+		t.Errorf("want forbidden error, got %v", err)
+	}
+
+	// the issued tokens are revoked if one of them fails.
+	revoked = nil
+	failOn = 721503
+	_, err = h.handle(context.Background(), "dummy-token", &requestBody{
+		Repositories: []repositoryRef{{Repository: "fuller-inc/actions"}},
+	})
+	if err == nil {
+		t.Fatal("want error, got nil")
+	}
+	if !slices.Contains(revoked, "ghs_token_641323") {
+		t.Errorf("the token is not revoked: %v", revoked)
+	}
+}
+
+func TestHandle_GitAuthor(t *testing.T) {
+	calls := 0
+	h := &Handler{
+		github: &githubClientMock{
+			ValidateAPIURLFunc: func(url string) error {
+				return nil
+			},
+			ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+				return &github.ActionsIDToken{
+					Claims: &jwt.Claims{
+						Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+					},
+					Repository:        "shogo82148/actions-github-app-token",
+					RepositoryID:      "398574950",
+					RepositoryOwnerID: "1157344",
+				}, nil
+			},
+			GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+				return &github.GetRepoResponse{
+					ID:     398574950,
+					NodeID: "R_kgDOF8HFZg",
+				}, nil
+			},
+			GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+				return nil, &github.UnexpectedStatusCodeError{
+					StatusCode: http.StatusNotFound,
+				}
+			},
+			GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+				return &github.GetReposInstallationResponse{
+					ID: 641323,
+				}, nil
+			},
+			GetUserFunc: func(ctx context.Context, token, username string) (*github.GetUserResponse, error) {
+				calls++
+				if token != "ghs_dummyGitHubToken" {
+					t.Errorf("unexpected token: got %q, want %q", token, "ghs_dummyGitHubToken")
+				}
+				if username != "octoapp[bot]" {
+					t.Errorf("unexpected username: got %q, want %q", username, "octoapp[bot]")
+				}
+				return &github.GetUserResponse{
+					Login: "octoapp[bot]",
+					ID:    41898282,
+					Type:  "Bot",
+				}, nil
+			},
+			CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, permissions *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+				return &github.CreateAppAccessTokenResponse{
+					Token: "ghs_dummyGitHubToken",
+				}, nil
+			},
+			RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+				return nil
+			},
+		},
+		app: &github.GetAppResponse{
+			Slug: "octoapp",
+		},
+		appID: 1234567890,
+	}
+
+	for range 2 {
+		resp, err := h.handle(context.Background(), "dummy-token", &requestBody{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "octoapp[bot]"; resp.GitAuthorName != want {
+			t.Errorf("unexpected name: got %q, want %q", resp.GitAuthorName, want)
+		}
+		if want := "41898282+octoapp[bot]@users.noreply.github.com"; resp.GitAuthorEmail != want {
+			t.Errorf("unexpected email: got %q, want %q", resp.GitAuthorEmail, want)
+		}
+	}
+
+	// the bot user is cached.
+	if calls != 1 {
+		t.Errorf("unexpected calls of GetUser: want 1, got %d", calls)
+	}
+
+	// the app on GitHub Enterprise Server.
+	client, err := github.NewClient(nil, 1234567890, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetAPIURL("https://ghes.example.com/api/v3"); err != nil {
+		t.Fatal(err)
+	}
+	h.noreply = client.NoReplyDomain()
+	resp, err := h.handle(context.Background(), "dummy-token", &requestBody{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "41898282+octoapp[bot]@noreply.ghes.example.com"; resp.GitAuthorEmail != want {
+		t.Errorf("unexpected email: got %q, want %q", resp.GitAuthorEmail, want)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"strconv"
+	"time"
 )
 
 type CreateAppAccessTokenRequest struct {
@@ -73,7 +74,17 @@ type CreateAppAccessTokenRequestPermissions struct {
 }
 
 type CreateAppAccessTokenResponse struct {
-	Token string `json:"token"`
+	Token               string                                    `json:"token"`
+	ExpiresAt           time.Time                                 `json:"expires_at"`
+	Permissions         map[string]string                         `json:"permissions"`
+	RepositorySelection string                                    `json:"repository_selection"`
+	Repositories        []*CreateAppAccessTokenResponseRepository `json:"repositories"`
+}
+
+type CreateAppAccessTokenResponseRepository struct {
+	ID       uint64 `json:"id"`
+	NodeID   string `json:"node_id"`
+	FullName string `json:"full_name"`
 
 	// omit other fields, we don't use them.
 }
@@ -9,6 +9,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/shogo82148/goat/jwa"
 	"github.com/shogo82148/goat/jws"
@@ -99,4 +100,13 @@ func TestCreateAppAccessToken(t *testing.T) {
 	if resp.Token != "ghs_dummyGitHubToken" {
 		t.Errorf("unexpected access token: want %q, got %q", "ghs_dummyGitHubToken", resp.Token)
 	}
+	if want := time.Date(2021, 9, 3, 13, 53, 17, 0, time.UTC); !resp.ExpiresAt.Equal(want) {
+		t.Errorf("unexpected expires_at: want %s, got %s", want, resp.ExpiresAt)
+	}
+	if resp.RepositorySelection != "selected" {
+		t.Errorf("unexpected repository selection: want %q, got %q", "selected", resp.RepositorySelection)
+	}
+	if len(resp.Repositories) != 1 || resp.Repositories[0].FullName != "shogo82148/actions-github-app-token" {
+		t.Errorf("unexpected repositories: %#v", resp.Repositories)
+	}
 }
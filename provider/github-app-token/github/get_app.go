@@ -7,6 +7,8 @@ import (
 )
 
 type GetAppResponse struct {
+	ID      uint64 `json:"id"`
+	Slug    string `json:"slug"`
 	HTMLURL string `json:"html_url"`
 
 	// omit other fields, we don't use them.
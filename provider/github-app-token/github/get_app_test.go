@@ -99,4 +99,7 @@ func TestGetApp(t *testing.T) {
 	if resp.HTMLURL != "https://github.com/apps/octoapp" {
 		t.Errorf("unexpected html url: want %q, got %q", "https://github.com/apps/octoapp", resp.HTMLURL)
 	}
+	if resp.Slug != "octoapp" {
+		t.Errorf("unexpected slug: want %q, got %q", "octoapp", resp.Slug)
+	}
 }
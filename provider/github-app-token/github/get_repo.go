@@ -8,8 +8,16 @@ import (
 )
 
 type GetRepoResponse struct {
-	ID     uint64 `json:"id"`
-	NodeID string `json:"node_id"`
+	ID       uint64 `json:"id"`
+	NodeID   string `json:"node_id"`
+	FullName string `json:"full_name"`
+
+	Owner *GetRepoResponseOwner `json:"owner"`
+}
+
+type GetRepoResponseOwner struct {
+	Login string `json:"login"`
+	ID    uint64 `json:"id"`
 }
 
 // GetRepo gets a repository.
@@ -8,7 +8,19 @@ import (
 )
 
 type GetReposInstallationResponse struct {
-	ID uint64 `json:"id"`
+	ID          uint64                               `json:"id"`
+	Account     *GetReposInstallationResponseAccount `json:"account"`
+	Permissions map[string]string                    `json:"permissions"`
+
+	// RepositorySelection is "all" or "selected".
+	RepositorySelection string `json:"repository_selection"`
+
+	// omit other fields, we don't use them.
+}
+
+type GetReposInstallationResponseAccount struct {
+	Login string `json:"login"`
+	ID    uint64 `json:"id"`
 
 	// omit other fields, we don't use them.
 }
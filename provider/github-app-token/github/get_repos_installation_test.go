@@ -93,4 +93,10 @@ func TestGetReposInstallation(t *testing.T) {
 	if resp.ID != 13865879 {
 		t.Errorf("unexpected installation id: want %d, got %d", 13865879, resp.ID)
 	}
+	if got := resp.Permissions["contents"]; got != "write" {
+		t.Errorf("unexpected contents permission: want %q, got %q", "write", got)
+	}
+	if resp.Account.Login != "shogo82148" {
+		t.Errorf("unexpected account: want %q, got %q", "shogo82148", resp.Account.Login)
+	}
 }
@@ -0,0 +1,51 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+type GetUserResponse struct {
+	Login  string `json:"login"`
+	ID     uint64 `json:"id"`
+	NodeID string `json:"node_id"`
+	Type   string `json:"type"`
+
+	// omit other fields, we don't use them.
+}
+
+// GetUser gets a user or an organization.
+// https://docs.github.com/en/rest/users/users#get-a-user
+func (c *Client) GetUser(ctx context.Context, token, username string) (*GetUserResponse, error) {
+	// build the request
+	u := c.baseURL.JoinPath("users", url.PathEscape(username))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", githubUserAgent)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("X-GitHub-Api-Version", githubAPIVersion)
+	req.Header.Set("X-Github-Next-Global-ID", "1")
+
+	// send the request
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// parse the response
+	if resp.StatusCode != http.StatusOK {
+		return nil, newErrUnexpectedStatusCode(resp)
+	}
+
+	var ret *GetUserResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
@@ -0,0 +1,61 @@
+package github
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestGetUser(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("unexpected method: want GET, got %s", r.Method)
+		}
+
+		auth := r.Header.Get("Authorization")
+		if auth != "Bearer secret" {
+			t.Errorf("unexpected Authorization header: %q", auth)
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		path := "/users/shogo82148"
+		if r.URL.Path != path {
+			t.Errorf("unexpected path: want %q, got %q", path, r.URL.Path)
+		}
+
+		data, err := os.ReadFile("testdata/user.json")
+		if err != nil {
+			panic(err)
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(data)
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(nil, 123456, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.baseURL, err = url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := c.GetUser(context.Background(), "secret", "shogo82148")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != 1157344 {
+		t.Errorf("unexpected id: want %d, got %d", 1157344, resp.ID)
+	}
+	if resp.Login != "shogo82148" {
+		t.Errorf("unexpected login: want %q, got %q", "shogo82148", resp.Login)
+	}
+}
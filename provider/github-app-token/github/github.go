@@ -19,7 +19,6 @@ import (
 	_ "github.com/shogo82148/goat/jwa/rs" // for RS256
 	"github.com/shogo82148/goat/jws"
 	"github.com/shogo82148/goat/jwt"
-	"github.com/shogo82148/goat/oidc"
 	"github.com/shogo82148/goat/sig"
 )
 
@@ -33,6 +32,9 @@ const (
 	// issuer of JWT tokens
 	oidcIssuer = "https://token.actions.githubusercontent.com"
 
+	// the domain of GitHub Enterprise Cloud with data residency
+	gheComDomain = ".ghe.com"
+
 	// The GitHub API version to use
 	// https://docs.github.com/en/rest/about-the-rest-api/api-versions
 	githubAPIVersion = "2026-03-10"
@@ -69,7 +71,26 @@ type Client struct {
 	keyID  string
 
 	// configure for OpenID Connect
-	oidcClient *oidc.Client
+	// issuer is the issuer of the OIDC tokens. empty means oidcIssuer.
+	issuer string
+	jwks   *jwksCache
+
+	// trusted are the other issuers that the client accepts.
+	trusted []*trustedIssuer
+
+	// jwksObserver receives the events of the caches of the JWK Sets.
+	jwksObserver JWKSObserver
+}
+
+// trustedIssuer is an issuer of the OIDC tokens other than the default one,
+// such as the unique issuer of an enterprise, https://token.actions.githubusercontent.com/ENTERPRISE.
+type trustedIssuer struct {
+	issuer string
+	jwks   *jwksCache
+
+	// owners are the owners of the repositories that the issuer can issue the tokens for.
+	// empty means any owner.
+	owners []string
 }
 
 // KMSService is a subset of AWS KMS client interface used for signing JWTs.
@@ -81,27 +102,147 @@ func NewClient(httpClient Doer, appID uint64, kmssvc KMSService, keyID string) (
 	if httpClient == nil {
 		httpClient = http.DefaultClient
 	}
-	oidcClient, err := oidc.NewClient(&oidc.ClientConfig{
-		Doer:      httpClient,
-		Issuer:    oidcIssuer,
-		UserAgent: githubUserAgent,
-	})
-	if err != nil {
-		return nil, err
-	}
-
 	c := &Client{
 		baseURL:    apiBaseURL,
 		httpClient: httpClient,
 		appID:      appID,
 		kmssvc:     kmssvc,
 		keyID:      keyID,
-		oidcClient: oidcClient,
 	}
+	jwks, err := newJWKSCache(c, oidcIssuer)
+	if err != nil {
+		return nil, err
+	}
+	c.jwks = jwks
 
 	return c, nil
 }
 
+// SetAPIURL changes the url of GitHub API from GITHUB_API_URL.
+func (c *Client) SetAPIURL(rawurl string) error {
+	canonical, err := canonicalURL(rawurl)
+	if err != nil {
+		return err
+	}
+	u, err := url.Parse(canonical)
+	if err != nil {
+		return err
+	}
+	c.baseURL = u
+	return nil
+}
+
+// CanonicalAPIURL returns the canonical form of the url of GitHub API, in the same way as SetAPIURL.
+// The empty url is GITHUB_API_URL, that the client uses by default.
+func CanonicalAPIURL(rawurl string) (string, error) {
+	if rawurl == "" {
+		rawurl = apiBaseURL.String()
+	}
+	return canonicalURL(rawurl)
+}
+
+// SetOIDCIssuer changes the issuer of the OIDC tokens that ParseIDToken accepts.
+func (c *Client) SetOIDCIssuer(issuer string) error {
+	jwks, err := newJWKSCache(c, issuer)
+	if err != nil {
+		return err
+	}
+	c.issuer = issuer
+	c.jwks = jwks
+	return nil
+}
+
+// AddTrustedIssuer adds an issuer of the OIDC tokens that ParseIDToken accepts.
+// If owners is not empty, the issuer is trusted only for the repositories of them.
+func (c *Client) AddTrustedIssuer(issuer string, owners []string) error {
+	jwks, err := newJWKSCache(c, issuer)
+	if err != nil {
+		return err
+	}
+	c.trusted = append(c.trusted, &trustedIssuer{
+		issuer: issuer,
+		jwks:   jwks,
+		owners: owners,
+	})
+	return nil
+}
+
+// SetJWKSLoader makes the client load the JWK Set of the issuer by loader, instead of the OIDC discovery.
+// The issuer must be the issuer of the client or one of the trusted issuers.
+func (c *Client) SetJWKSLoader(issuer string, loader JWKSLoader) error {
+	if issuer == c.oidcIssuer() {
+		c.jwks.loader = loader
+		return nil
+	}
+	for _, t := range c.trusted {
+		if t.issuer == issuer {
+			t.jwks.loader = loader
+			return nil
+		}
+	}
+	return fmt.Errorf("github: unknown issuer: %s", issuer)
+}
+
+// SetJWKSObserver sets the function that receives the events of the caches of the JWK Sets, for the metrics.
+func (c *Client) SetJWKSObserver(f JWKSObserver) {
+	c.jwksObserver = f
+}
+
+// OIDCIssuer returns the issuer of the OIDC tokens that ParseIDToken accepts.
+func (c *Client) OIDCIssuer() string {
+	return c.oidcIssuer()
+}
+
+func (c *Client) oidcIssuer() string {
+	if c.issuer == "" {
+		return oidcIssuer
+	}
+	return c.issuer
+}
+
+// DefaultOIDCIssuer returns the issuer of the OIDC tokens for the GitHub API url.
+// GitHub Enterprise Cloud with data residency issues the tokens at https://token.actions.TENANT.ghe.com,
+// and GitHub Enterprise Server issues them at https://HOSTNAME/_services/token.
+func DefaultOIDCIssuer(apiURL string) (string, error) {
+	canonical, err := canonicalURL(apiURL)
+	if err != nil {
+		return "", err
+	}
+	if canonical == defaultAPIBaseURL {
+		return oidcIssuer, nil
+	}
+	u, err := url.Parse(canonical)
+	if err != nil {
+		return "", err
+	}
+	if tenant, ok := gheComTenant(u.Hostname()); ok {
+		return "https://token.actions." + tenant + gheComDomain, nil
+	}
+	return (&url.URL{
+		Scheme: u.Scheme,
+		Host:   u.Host,
+		Path:   "/_services/token",
+	}).String(), nil
+}
+
+// NoReplyDomain returns the domain of the noreply email addresses of the users on the GitHub API,
+// such as users.noreply.github.com for github.com, users.noreply.TENANT.ghe.com for GitHub Enterprise Cloud with data residency,
+// and noreply.HOSTNAME for GitHub Enterprise Server.
+func (c *Client) NoReplyDomain() string {
+	canonical, err := canonicalURL(c.baseURL.String())
+	if err != nil || canonical == defaultAPIBaseURL {
+		return "users.noreply.github.com"
+	}
+	u, err := url.Parse(canonical)
+	if err != nil {
+		return "users.noreply.github.com"
+	}
+	if tenant, ok := gheComTenant(u.Hostname()); ok {
+		return "users.noreply." + tenant + gheComDomain
+	}
+	return "noreply." + u.Hostname()
+}
+
 // generate JSON Web Token for authentication the app
 // https://docs.github.com/en/developers/apps/building-github-apps/authenticating-with-github-apps#authenticating-as-a-github-app
 func (c *Client) generateJWT(ctx context.Context) (string, error) {
@@ -167,9 +308,9 @@ func (c *Client) ValidateAPIURL(url string) error {
 	if u != c.baseURL.String() {
 		if c.baseURL.String() == defaultAPIBaseURL {
 			return errors.New(
-				"it looks that you use GitHub Enterprise Server, " +
-					"but the credential provider doesn't support it. " +
-					"I recommend you to build your own credential provider",
+				"it looks that you use GitHub Enterprise Server or GHE.com, " +
+					"but the credential provider is not configured for it. " +
+					"Ask the operator to add the app on your server, or build your own credential provider",
 			)
 		}
 		return errors.New("your api server is not verified by the credential provider")
@@ -217,6 +358,19 @@ func newErrUnexpectedStatusCode(resp *http.Response) *UnexpectedStatusCodeError
 	}
 }
 
+// gheComTenant returns the tenant of GitHub Enterprise Cloud with data residency,
+// if host is TENANT.ghe.com or one of its subdomains, such as api.TENANT.ghe.com.
+func gheComTenant(host string) (string, bool) {
+	rest, ok := strings.CutSuffix(host, gheComDomain)
+	if !ok || rest == "" {
+		return "", false
+	}
+	if i := strings.LastIndexByte(rest, '.'); i >= 0 {
+		rest = rest[i+1:]
+	}
+	return rest, rest != ""
+}
+
 func canonicalURL(rawurl string) (string, error) {
 	u, err := url.Parse(rawurl)
 	if err != nil {
@@ -247,6 +401,13 @@ func canonicalURL(rawurl string) (string, error) {
 		port = ""
 	}
 
+	// GitHub Enterprise Cloud with data residency serves the API at api.TENANT.ghe.com,
+	// and TENANT.ghe.com/api/v3 is an alias of it.
+	if tenant, ok := gheComTenant(host); ok && port == "" && (u.Path == "/api/v3" || u.Path == "") {
+		host = "api." + tenant + gheComDomain
+		u.Path = ""
+	}
+
 	if port == "" {
 		u.Host = host
 	} else {
@@ -93,6 +93,14 @@ func TestCanonicalURL(t *testing.T) {
 			input: "https://[::1]:8080/api",
 			want:  "https://[::1]:8080/api",
 		},
+		{
+			input: "https://API.Octocorp.GHE.com/",
+			want:  "https://api.octocorp.ghe.com",
+		},
+		{
+			input: "https://octocorp.ghe.com/api/v3",
+			want:  "https://api.octocorp.ghe.com",
+		},
 	}
 	for i, c := range cases {
 		got, err := canonicalURL(c.input)
@@ -113,3 +121,85 @@ func readPublicKeyForTest() (*jwk.Key, error) {
 	}
 	return jwk.ParseKey(data)
 }
+
+func TestSetAPIURL(t *testing.T) {
+	c, err := NewClient(nil, 123456, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetAPIURL("https://GHE.EXAMPLE.COM/api/v3/"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ValidateAPIURL("https://ghe.example.com/api/v3"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := c.ValidateAPIURL("https://api.github.com"); err == nil {
+		t.Error("want error, got nil")
+	}
+}
+
+func TestDefaultOIDCIssuer(t *testing.T) {
+	cases := []struct {
+		apiURL string
+		want   string
+	}{
+		{
+			apiURL: "https://api.github.com/",
+			want:   "https://token.actions.githubusercontent.com",
+		},
+		{
+			apiURL: "https://GHES.example.com/api/v3",
+			want:   "https://ghes.example.com/_services/token",
+		},
+		{
+			apiURL: "https://api.octocorp.ghe.com",
+			want:   "https://token.actions.octocorp.ghe.com",
+		},
+	}
+	for _, c := range cases {
+		got, err := DefaultOIDCIssuer(c.apiURL)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.apiURL, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: want %q, got %q", c.apiURL, c.want, got)
+		}
+	}
+}
+
+func TestNoReplyDomain(t *testing.T) {
+	cases := []struct {
+		apiURL string
+		want   string
+	}{
+		{
+			apiURL: "https://api.github.com/",
+			want:   "users.noreply.github.com",
+		},
+		{
+			apiURL: "https://GHES.example.com/api/v3",
+			want:   "noreply.ghes.example.com",
+		},
+		{
+			apiURL: "https://api.octocorp.ghe.com",
+			want:   "users.noreply.octocorp.ghe.com",
+		},
+		{
+			apiURL: "https://octocorp.ghe.com/api/v3",
+			want:   "users.noreply.octocorp.ghe.com",
+		},
+	}
+	for _, c := range cases {
+		client, err := NewClient(nil, 123456, nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SetAPIURL(c.apiURL); err != nil {
+			t.Fatal(err)
+		}
+		if got := client.NoReplyDomain(); got != c.want {
+			t.Errorf("%s: want %q, got %q", c.apiURL, c.want, got)
+		}
+	}
+}
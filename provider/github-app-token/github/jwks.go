@@ -0,0 +1,299 @@
+package github
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shogo82148/goat/jwk"
+	"github.com/shogo82148/goat/oidc"
+)
+
+const (
+	// jwksDefaultTTL is how long the JWK Set is cached if the response has no Cache-Control.
+	jwksDefaultTTL = time.Hour
+
+	// jwksMinTTL and jwksMaxTTL clamp the lifetime in Cache-Control.
+	// GitHub Actions responds "cache-control: no-store,no-cache",
+	// but fetching the JWK Set for every token costs a round trip in each invocation,
+	// so such responses are cached for jwksMinTTL.
+	jwksMinTTL = time.Minute
+	jwksMaxTTL = 24 * time.Hour
+
+	// jwksRefreshInterval is the minimum interval of the refreshes for unknown kids,
+	// and of the retries after a failed refresh while the stale JWK Set is usable.
+	// It prevents the tokens with random kids from flooding the issuer.
+	jwksRefreshInterval = time.Minute
+
+	// jwksFetchTimeout is the timeout of fetching the JWK Set.
+	// The fetch doesn't use the context of the request, because the other requests wait for it.
+	jwksFetchTimeout = 10 * time.Second
+
+	// jwksMaxStale is how long the expired JWK Set is used while the issuer is failing.
+	jwksMaxStale = 24 * time.Hour
+
+	// jwksFileCheckInterval is the interval to check the modification of the JWK Set file.
+	jwksFileCheckInterval = 10 * time.Second
+)
+
+// JWKSEvent is an event of the cache of the JWK Set.
+type JWKSEvent string
+
+const (
+	// JWKSCacheHit means that the cached JWK Set is used.
+	JWKSCacheHit JWKSEvent = "hit"
+
+	// JWKSRefreshExpired means that the JWK Set is fetched because the cache is empty or expired.
+	JWKSRefreshExpired JWKSEvent = "refresh_expired"
+
+	// JWKSRefreshUnknownKID means that the JWK Set is fetched because the token has an unknown kid.
+	JWKSRefreshUnknownKID JWKSEvent = "refresh_unknown_kid"
+
+	// JWKSRefreshRateLimited means that the token has an unknown kid,
+	// but the JWK Set is not fetched because it was fetched recently.
+	JWKSRefreshRateLimited JWKSEvent = "refresh_rate_limited"
+
+	// JWKSRefreshFailed means that fetching the JWK Set failed.
+	JWKSRefreshFailed JWKSEvent = "refresh_failed"
+
+	// JWKSServeStale means that the expired JWK Set is used, because fetching it failed recently.
+	JWKSServeStale JWKSEvent = "serve_stale"
+)
+
+// JWKSObserver receives the events of the cache of the JWK Set, for the metrics.
+type JWKSObserver func(ctx context.Context, issuer string, event JWKSEvent)
+
+// JWKSLoader loads the JWK Set of an issuer without the OIDC discovery,
+// for the issuers that the API can't reach, such as GitHub Enterprise Server in an isolated network.
+type JWKSLoader interface {
+	// LoadJWKS returns the JWK Set and how long it can be cached.
+	LoadJWKS(ctx context.Context) (*jwk.Set, time.Duration, error)
+}
+
+// jwksCache caches the JWK Set of an OIDC issuer.
+type jwksCache struct {
+	issuer     string
+	httpClient Doer
+	oidcClient *oidc.Client
+	client     *Client
+	now        func() time.Time
+
+	// loader loads the JWK Set. nil means the OIDC discovery.
+	loader JWKSLoader
+
+	mu          sync.Mutex
+	set         *jwk.Set
+	expiresAt   time.Time
+	attemptedAt time.Time // the last attempt to fetch, even if it failed.
+	err         error     // the error of the last attempt.
+}
+
+func newJWKSCache(c *Client, issuer string) (*jwksCache, error) {
+	oidcClient, err := oidc.NewClient(&oidc.ClientConfig{
+		Doer:      c.httpClient,
+		Issuer:    issuer,
+		UserAgent: githubUserAgent,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &jwksCache{
+		issuer:     issuer,
+		httpClient: c.httpClient,
+		oidcClient: oidcClient,
+		client:     c,
+		now:        time.Now,
+	}, nil
+}
+
+// find returns the key that has the kid.
+// If the kid is unknown, it refreshes the JWK Set once, because the issuer may rotate the keys.
+// While the issuer is failing, it keeps using the expired JWK Set up to jwksMaxStale.
+func (j *jwksCache) find(ctx context.Context, kid string) (*jwk.Key, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	now := j.now()
+	fetched := false
+	switch {
+	case j.set != nil && now.Before(j.expiresAt):
+		j.observe(ctx, JWKSCacheHit)
+	case j.err != nil && now.Sub(j.attemptedAt) < jwksRefreshInterval && j.usable(now):
+		// the last attempt failed just now, so don't retry yet.
+		// without the usable JWK Set, it retries right away, because it can't verify any token.
+		j.observe(ctx, JWKSServeStale)
+	default:
+		if err := j.refresh(ctx, now, JWKSRefreshExpired); err != nil {
+			if !j.usable(now) {
+				return nil, err
+			}
+			j.observe(ctx, JWKSServeStale)
+		} else {
+			fetched = true
+		}
+	}
+	if key, ok := j.set.Find(kid); ok {
+		return key, nil
+	}
+	if fetched {
+		return nil, fmt.Errorf("github: kid %s is not found", kid)
+	}
+
+	if now.Sub(j.attemptedAt) < jwksRefreshInterval {
+		j.observe(ctx, JWKSRefreshRateLimited)
+		return nil, fmt.Errorf("github: kid %s is not found", kid)
+	}
+	if err := j.refresh(ctx, now, JWKSRefreshUnknownKID); err != nil {
+		return nil, err
+	}
+	if key, ok := j.set.Find(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("github: kid %s is not found", kid)
+}
+
+// usable reports whether the JWK Set can be used after the refresh failed. j.mu must be held.
+func (j *jwksCache) usable(now time.Time) bool {
+	return j.set != nil && now.Before(j.expiresAt.Add(jwksMaxStale))
+}
+
+// refresh fetches the JWK Set. j.mu must be held.
+// The attempt is recorded even if it fails, to rate-limit the retries,
+// except for the cancellation, which is not the failure of the issuer.
+func (j *jwksCache) refresh(ctx context.Context, now time.Time, event JWKSEvent) error {
+	fetchCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+	defer cancel()
+	set, ttl, err := j.fetch(fetchCtx)
+	if err != nil {
+		j.observe(ctx, JWKSRefreshFailed)
+		if !errors.Is(err, context.Canceled) {
+			j.attemptedAt = now
+			j.err = err
+		}
+		return fmt.Errorf("github: failed to get JWK Set: %w", err)
+	}
+	j.observe(ctx, event)
+	j.attemptedAt = now
+	j.set = set
+	j.expiresAt = now.Add(ttl)
+	j.err = nil
+	return nil
+}
+
+func (j *jwksCache) fetch(ctx context.Context) (*jwk.Set, time.Duration, error) {
+	if j.loader != nil {
+		return j.loader.LoadJWKS(ctx)
+	}
+
+	cfg, err := j.oidcClient.GetConfig(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.JWKSURI, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("User-Agent", githubUserAgent)
+	req.Header.Set("Accept", "application/jwk-set+json")
+	resp, err := j.httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, newErrUnexpectedStatusCode(resp)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	set, err := jwk.ParseSet(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return set, jwksTTL(resp.Header), nil
+}
+
+func (j *jwksCache) observe(ctx context.Context, event JWKSEvent) {
+	if f := j.client.jwksObserver; f != nil {
+		f(ctx, j.issuer, event)
+	}
+}
+
+// jwksTTL returns how long the JWK Set can be cached, from the Cache-Control header.
+func jwksTTL(header http.Header) time.Duration {
+	directives := strings.Split(strings.ToLower(header.Get("Cache-Control")), ",")
+	ttl := time.Duration(-1)
+	for _, d := range directives {
+		name, value, _ := strings.Cut(strings.TrimSpace(d), "=")
+		switch name {
+		case "no-store", "no-cache":
+			return jwksMinTTL
+		case "max-age":
+			sec, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+			if err != nil || sec < 0 {
+				continue
+			}
+			if sec > int64(jwksMaxTTL/time.Second) {
+				return jwksMaxTTL
+			}
+			ttl = time.Duration(sec) * time.Second
+		}
+	}
+	if ttl < 0 {
+		return jwksDefaultTTL
+	}
+	return max(ttl, jwksMinTTL)
+}
+
+// fileJWKSLoader loads the JWK Set from a local file.
+// It reloads the file when the file is modified.
+type fileJWKSLoader struct {
+	path string
+
+	mu      sync.Mutex
+	set     *jwk.Set
+	modTime time.Time
+	size    int64
+}
+
+// NewFileJWKSLoader returns the JWKSLoader that loads the JWK Set from the file.
+// The modification of the file is checked every 10 seconds, so the keys can be rotated without restarting.
+func NewFileJWKSLoader(path string) JWKSLoader {
+	return &fileJWKSLoader{path: path}
+}
+
+func (l *fileJWKSLoader) LoadJWKS(ctx context.Context) (*jwk.Set, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if l.set != nil && info.ModTime().Equal(l.modTime) && info.Size() == l.size {
+		return l.set, jwksFileCheckInterval, nil
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return nil, 0, err
+	}
+	set, err := jwk.ParseSet(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid JWK Set in %s: %w", l.path, err)
+	}
+	l.set = set
+	l.modTime = info.ModTime()
+	l.size = info.Size()
+	return set, jwksFileCheckInterval, nil
+}
@@ -0,0 +1,388 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shogo82148/goat/jwt"
+)
+
+func TestJWKSTTL(t *testing.T) {
+	cases := []struct {
+		cacheControl string
+		want         time.Duration
+	}{
+		{"", jwksDefaultTTL},
+		{"public", jwksDefaultTTL},
+		{"max-age=600", 10 * time.Minute},
+		{"public, max-age=600", 10 * time.Minute},
+		{"max-age=\"600\"", 10 * time.Minute},
+		{"max-age=1", jwksMinTTL},
+		{"max-age=31536000", jwksMaxTTL},
+		{"max-age=invalid", jwksDefaultTTL},
+		{"no-store,no-cache", jwksMinTTL},
+		{"max-age=600, no-cache", jwksMinTTL},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		if c.cacheControl != "" {
+			header.Set("Cache-Control", c.cacheControl)
+		}
+		if got := jwksTTL(header); got != c.want {
+			t.Errorf("%q: want %s, got %s", c.cacheControl, c.want, got)
+		}
+	}
+}
+
+func TestJWKSCache(t *testing.T) {
+	pub, err := os.ReadFile("testdata/id_rsa_pub.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key map[string]any
+	if err := json.Unmarshal(pub, &key); err != nil {
+		t.Fatal(err)
+	}
+
+	// the issuer rotates the key by changing kid.
+	var kid atomic.Value
+	kid.Store("key-1")
+	var fetches atomic.Int32
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]any{
+				"issuer":   ts.URL,
+				"jwks_uri": ts.URL + "/.well-known/jwks",
+			})
+		case "/.well-known/jwks":
+			fetches.Add(1)
+			k := map[string]any{}
+			for name, v := range key {
+				k[name] = v
+			}
+			k["kid"] = kid.Load()
+			w.Header().Set("Cache-Control", "max-age=3600")
+			json.NewEncoder(w).Encode(map[string]any{
+				"keys": []any{k},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(ts.Client(), 123456, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetOIDCIssuer(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	var events []JWKSEvent
+	c.SetJWKSObserver(func(ctx context.Context, issuer string, event JWKSEvent) {
+		if issuer != ts.URL {
+			t.Errorf("unexpected issuer: %q", issuer)
+		}
+		events = append(events, event)
+	})
+	now := time.Now()
+	c.jwks.now = func() time.Time { return now }
+	ctx := t.Context()
+
+	// the first token fetches the JWK Set, and the second one uses the cache.
+	if _, err := c.jwks.find(ctx, "key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.jwks.find(ctx, "key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("want 1 fetch, got %d", got)
+	}
+
+	// the key is rotated, but the JWK Set was fetched just now.
+	kid.Store("key-2")
+	if _, err := c.jwks.find(ctx, "key-2"); err == nil {
+		t.Error("want error, but not")
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("want 1 fetch, got %d", got)
+	}
+
+	// after the interval, the unknown kid refreshes the JWK Set.
+	now = now.Add(jwksRefreshInterval)
+	if _, err := c.jwks.find(ctx, "key-2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("want 2 fetches, got %d", got)
+	}
+
+	// the cache expires as Cache-Control says.
+	now = now.Add(time.Hour)
+	if _, err := c.jwks.find(ctx, "key-2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetches.Load(); got != 3 {
+		t.Errorf("want 3 fetches, got %d", got)
+	}
+
+	want := []JWKSEvent{
+		JWKSRefreshExpired,
+		JWKSCacheHit,
+		JWKSCacheHit,
+		JWKSRefreshRateLimited,
+		JWKSCacheHit,
+		JWKSRefreshUnknownKID,
+		JWKSRefreshExpired,
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("unexpected events: want %v, got %v", want, events)
+	}
+}
+
+func TestJWKSCache_Failure(t *testing.T) {
+	pub, err := os.ReadFile("testdata/id_rsa_pub.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key map[string]any
+	if err := json.Unmarshal(pub, &key); err != nil {
+		t.Fatal(err)
+	}
+	key["kid"] = "key-1"
+
+	var failing atomic.Bool
+	var fetches atomic.Int32
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]any{
+				"issuer":   ts.URL,
+				"jwks_uri": ts.URL + "/.well-known/jwks",
+			})
+		case "/.well-known/jwks":
+			fetches.Add(1)
+			if failing.Load() {
+				http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Cache-Control", "max-age=3600")
+			json.NewEncoder(w).Encode(map[string]any{
+				"keys": []any{key},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(ts.Client(), 123456, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetOIDCIssuer(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	var events []JWKSEvent
+	c.SetJWKSObserver(func(ctx context.Context, issuer string, event JWKSEvent) {
+		events = append(events, event)
+	})
+	now := time.Now()
+	c.jwks.now = func() time.Time { return now }
+	ctx := t.Context()
+	find := func(kid string, wantFetches int32, wantErr bool) {
+		t.Helper()
+		_, err := c.jwks.find(ctx, kid)
+		if wantErr && err == nil {
+			t.Errorf("%s: want error, but not", kid)
+		}
+		if !wantErr && err != nil {
+			t.Errorf("%s: unexpected error: %v", kid, err)
+		}
+		if got := fetches.Load(); got != wantFetches {
+			t.Errorf("%s: want %d fetches, got %d", kid, wantFetches, got)
+		}
+	}
+
+	// the issuer is failing before the first fetch.
+	failing.Store(true)
+	find("key-1", 1, true)
+	find("key-1", 2, true) // no keys are usable, so it retries right away.
+
+	failing.Store(false)
+	find("key-1", 3, false)
+
+	// the cache expires while the issuer is failing, but the previous keys are still usable.
+	failing.Store(true)
+	now = now.Add(time.Hour)
+	find("key-1", 4, false)
+	find("key-1", 4, false)
+	find("random-kid", 4, true)
+
+	// it retries after the interval.
+	now = now.Add(jwksRefreshInterval)
+	find("key-1", 5, false)
+
+	// the keys are too old to use.
+	now = now.Add(jwksMaxStale)
+	find("key-1", 6, true)
+
+	want := []JWKSEvent{
+		JWKSRefreshFailed,
+		JWKSRefreshFailed,
+		JWKSRefreshExpired,
+		JWKSRefreshFailed,
+		JWKSServeStale,
+		JWKSServeStale,
+		JWKSServeStale,
+		JWKSRefreshRateLimited,
+		JWKSRefreshFailed,
+		JWKSServeStale,
+		JWKSRefreshFailed,
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("unexpected events: want %v, got %v", want, events)
+	}
+}
+
+func TestJWKSCache_Canceled(t *testing.T) {
+	pub, err := os.ReadFile("testdata/id_rsa_pub.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key map[string]any
+	if err := json.Unmarshal(pub, &key); err != nil {
+		t.Fatal(err)
+	}
+	key["kid"] = "key-1"
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]any{
+				"issuer":   ts.URL,
+				"jwks_uri": ts.URL + "/.well-known/jwks",
+			})
+		case "/.well-known/jwks":
+			json.NewEncoder(w).Encode(map[string]any{
+				"keys": []any{key},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	c, err := NewClient(ts.Client(), 123456, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetOIDCIssuer(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	// the canceled request doesn't fail the fetch that the other requests wait for.
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := c.jwks.find(ctx, "key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if c.jwks.err != nil {
+		t.Errorf("unexpected error: %v", c.jwks.err)
+	}
+}
+
+// offlineDoer fails the test on any request.
+type offlineDoer struct {
+	t *testing.T
+}
+
+func (d offlineDoer) Do(req *http.Request) (*http.Response, error) {
+	d.t.Errorf("unexpected request: %s %s", req.Method, req.URL)
+	return nil, errors.New("offline")
+}
+
+func TestParseIDToken_FileJWKS(t *testing.T) {
+	_, sign := newTestIssuer(t)
+	const issuer = "https://ghes.example.com/_services/token"
+	c, err := NewClient(offlineDoer{t}, 123456, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetOIDCIssuer(issuer); err != nil {
+		t.Fatal(err)
+	}
+
+	// the file has the old key at first.
+	data, err := os.ReadFile("testdata/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, bytes.ReplaceAll(data, []byte(`"test-key"`), []byte(`"old-key"`)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetJWKSLoader(issuer, NewFileJWKSLoader(path)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetJWKSLoader("https://unknown.example.com", NewFileJWKSLoader(path)); err == nil {
+		t.Error("want error for the unknown issuer, but not")
+	}
+	now := time.Now()
+	c.jwks.now = func() time.Time { return now }
+
+	newToken := func() string {
+		issuedAt := time.Now()
+		return sign(&jwt.Claims{
+			Issuer:         issuer,
+			Subject:        "repo:octocat/hello-world:ref:refs/heads/main",
+			Audience:       []string{"https://github-app.shogo82148.com/123456"},
+			IssuedAt:       issuedAt,
+			NotBefore:      issuedAt,
+			ExpirationTime: issuedAt.Add(5 * time.Minute),
+			Raw: map[string]any{
+				"repository":    "octocat/hello-world",
+				"repository_id": "1296269",
+			},
+		})
+	}
+	if _, err := c.ParseIDToken(t.Context(), newToken()); err == nil || !strings.Contains(err.Error(), "kid test-key is not found") {
+		t.Errorf("want kid error, got %v", err)
+	}
+
+	// the key is rotated.
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(jwksRefreshInterval)
+	id, err := c.ParseIDToken(t.Context(), newToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Repository != "octocat/hello-world" {
+		t.Errorf("unexpected repository: %q", id.Repository)
+	}
+}
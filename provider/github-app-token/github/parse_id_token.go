@@ -2,8 +2,11 @@ package github
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/shogo82148/goat/jwa"
@@ -18,6 +21,7 @@ type ActionsIDToken struct {
 	*jwt.Claims
 	Environment          string `jwt:"environment"`
 	Ref                  string `jwt:"ref"`
+	RefProtected         string `jwt:"ref_protected"`
 	SHA                  string `jwt:"sha"`
 	Repository           string `jwt:"repository"`
 	RepositoryOwner      string `jwt:"repository_owner"`
@@ -28,26 +32,34 @@ type ActionsIDToken struct {
 	RunID                string `jwt:"run_id"`
 	RunNumber            string `jwt:"run_number"`
 	RunAttempt           string `jwt:"run_attempt"`
+	RunnerEnvironment    string `jwt:"runner_environment"`
 	Actor                string `jwt:"actor"`
 	Workflow             string `jwt:"workflow"`
+	WorkflowRef          string `jwt:"workflow_ref"`
+	WorkflowSHA          string `jwt:"workflow_sha"`
 	HeadRef              string `jwt:"head_ref"`
 	BaseRef              string `jwt:"base_ref"`
 	EventName            string `jwt:"event_name"`
-	EventType            string `jwt:"branch"`
 	RefType              string `jwt:"ref_type"`
 	JobWorkflowRef       string `jwt:"job_workflow_ref"`
+	JobWorkflowSHA       string `jwt:"job_workflow_sha"`
+	CheckRunID           string `jwt:"check_run_id"`
+
+	// Enterprise and EnterpriseID are set only if the repository belongs to an enterprise.
+	Enterprise   string `jwt:"enterprise"`
+	EnterpriseID string `jwt:"enterprise_id"`
 }
 
 func (c *Client) ParseIDToken(ctx context.Context, idToken string) (*ActionsIDToken, error) {
-	set, err := c.oidcClient.GetJWKS(ctx)
+	issuer, err := c.findIssuer(idToken)
 	if err != nil {
-		return nil, fmt.Errorf("github: failed to get JWK Set: %w", err)
+		return nil, fmt.Errorf("github: failed to parse id token: %w", err)
 	}
 	p := &jwt.Parser{
 		KeyFinder: jwt.FindKeyFunc(func(ctx context.Context, header *jws.Header) (key sig.SigningKey, err error) {
-			jwk, ok := set.Find(header.KeyID())
-			if !ok {
-				return nil, fmt.Errorf("github: kid %s is not found", header.KeyID())
+			jwk, err := issuer.jwks.find(ctx, header.KeyID())
+			if err != nil {
+				return nil, err
 			}
 			if jwk.Algorithm() != "" && header.Algorithm().KeyAlgorithm() != jwk.Algorithm() {
 				return nil, fmt.Errorf("github: alg parameter mismatch")
@@ -57,13 +69,13 @@ func (c *Client) ParseIDToken(ctx context.Context, idToken string) (*ActionsIDTo
 		}),
 		AlgorithmVerifier:     jwt.AllowedAlgorithms{jwa.RS256},
 		AudienceVerifier:      jwt.UnsecureAnyAudience,
-		IssuerSubjectVerifier: jwt.Issuer(oidcIssuer),
+		IssuerSubjectVerifier: jwt.Issuer(issuer.issuer),
 	}
 	token, err := p.Parse(ctx, []byte(idToken))
 	if err != nil {
 		return nil, fmt.Errorf("github: failed to parse id token: %w", err)
 	}
-	if token.Claims.Issuer != oidcIssuer {
+	if token.Claims.Issuer != issuer.issuer {
 		return nil, errors.New("github: failed to parse id token: invalid issuer")
 	}
 
@@ -73,8 +85,81 @@ func (c *Client) ParseIDToken(ctx context.Context, idToken string) (*ActionsIDTo
 	}
 	claims.Claims = token.Claims
 
-	if !strings.HasPrefix(claims.Claims.Subject, fmt.Sprintf("repo:%s:", claims.Repository)) {
-		return nil, errors.New("github: failed to parse id token: invalid subject")
+	// the subject may be customized, such as "repo_id:123:context:prod",
+	// so the token is bound to the repository by the repository claims.
+	// The callers verify them against GitHub API.
+	if claims.Repository == "" || claims.RepositoryID == "" {
+		return nil, errors.New("github: failed to parse id token: the repository claims are missing")
+	}
+	if len(issuer.owners) > 0 && !slices.ContainsFunc(issuer.owners, func(owner string) bool {
+		return strings.EqualFold(owner, claims.RepositoryOwner)
+	}) {
+		return nil, fmt.Errorf("github: failed to parse id token: the issuer %s is not trusted for %s", issuer.issuer, claims.RepositoryOwner)
 	}
 	return &claims, nil
 }
+
+// findIssuer finds the trusted issuer of the token.
+// It peeks the iss claim without verifying the token, to choose the JWK Set to verify it.
+func (c *Client) findIssuer(idToken string) (*trustedIssuer, error) {
+	claims, err := PeekClaims(idToken)
+	if err != nil {
+		return nil, err
+	}
+	iss := claims.Issuer
+	if iss == c.oidcIssuer() {
+		return &trustedIssuer{
+			issuer: iss,
+			jwks:   c.jwks,
+		}, nil
+	}
+	for _, t := range c.trusted {
+		if t.issuer == iss {
+			return t, nil
+		}
+	}
+	return nil, errors.New("invalid issuer")
+}
+
+// UnverifiedClaims are the claims of a JSON Web Token that are read without verifying it.
+// They are only for choosing how to verify the token.
+type UnverifiedClaims struct {
+	Issuer   string
+	Audience []string
+}
+
+// PeekClaims returns the iss and aud claims of the JSON Web Token without verifying it.
+func PeekClaims(idToken string) (*UnverifiedClaims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed payload: %w", err)
+	}
+	var payload struct {
+		Issuer   string          `json:"iss"`
+		Audience json.RawMessage `json:"aud"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return nil, fmt.Errorf("malformed payload: %w", err)
+	}
+	claims := &UnverifiedClaims{
+		Issuer: payload.Issuer,
+	}
+	if len(payload.Audience) == 0 {
+		return claims, nil
+	}
+
+	// aud is a string or an array of strings.
+	var aud string
+	if err := json.Unmarshal(payload.Audience, &aud); err == nil {
+		claims.Audience = []string{aud}
+		return claims, nil
+	}
+	if err := json.Unmarshal(payload.Audience, &claims.Audience); err != nil {
+		return nil, fmt.Errorf("malformed aud: %w", err)
+	}
+	return claims, nil
+}
@@ -2,15 +2,22 @@ package github
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/shogo82148/goat/oidc"
+	"github.com/shogo82148/goat/jwa"
+	"github.com/shogo82148/goat/jwk"
+	"github.com/shogo82148/goat/jws"
+	"github.com/shogo82148/goat/jwt"
 )
 
 func TestParseIDToken_Integrated(t *testing.T) {
@@ -30,19 +37,10 @@ func TestParseIDToken_Integrated(t *testing.T) {
 		}
 		t.Logf("the id is issued at %s", time.Now())
 
-		oidcClient, err := oidc.NewClient(&oidc.ClientConfig{
-			Doer:   http.DefaultClient,
-			Issuer: oidcIssuer,
-		})
+		c, err := NewClient(http.DefaultClient, 0, nil, "")
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		c := &Client{
-			baseURL:    apiBaseURL,
-			httpClient: http.DefaultClient,
-			oidcClient: oidcClient,
-		}
 		id, err := c.ParseIDToken(ctx, token)
 		if err != nil {
 			t.Fatal(err)
@@ -68,19 +66,10 @@ func TestParseIDToken_Integrated(t *testing.T) {
 		}
 		t.Logf("the id is issued at %s", time.Now())
 
-		oidcClient, err := oidc.NewClient(&oidc.ClientConfig{
-			Doer:   http.DefaultClient,
-			Issuer: oidcIssuer,
-		})
+		c, err := NewClient(http.DefaultClient, 0, nil, "")
 		if err != nil {
 			t.Fatal(err)
 		}
-
-		c := &Client{
-			baseURL:    apiBaseURL,
-			httpClient: http.DefaultClient,
-			oidcClient: oidcClient,
-		}
 		id, err := c.ParseIDToken(ctx, token)
 		if err != nil {
 			t.Fatal(err)
@@ -132,3 +121,338 @@ func getIdToken(ctx context.Context, audience, idToken, idURL string) (string, e
 	}
 	return result.Value, nil
 }
+
+// newTestIssuer starts an OIDC issuer that signs the tokens with testdata/id_rsa_for_testing.pem.
+func newTestIssuer(t *testing.T) (*httptest.Server, func(claims *jwt.Claims) string) {
+	t.Helper()
+	pub, err := os.ReadFile("testdata/id_rsa_pub.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key map[string]any
+	if err := json.Unmarshal(pub, &key); err != nil {
+		t.Fatal(err)
+	}
+	key["kid"] = "test-key"
+
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/.well-known/openid-configuration"):
+			issuer := ts.URL + strings.TrimSuffix(r.URL.Path, "/.well-known/openid-configuration")
+			json.NewEncoder(w).Encode(map[string]any{
+				"issuer":   issuer,
+				"jwks_uri": ts.URL + "/.well-known/jwks",
+			})
+		case r.URL.Path == "/.well-known/jwks":
+			json.NewEncoder(w).Encode(map[string]any{
+				"keys": []any{key},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	priv, err := os.ReadFile("testdata/id_rsa_for_testing.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _, err := jwk.DecodePEM(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := jwa.RS256.New().NewSigningKey(k)
+	sign := func(claims *jwt.Claims) string {
+		header := jws.NewHeader()
+		header.SetType("JWT")
+		header.SetAlgorithm(jwa.RS256)
+		header.SetKeyID("test-key")
+		token, err := jwt.Sign(header, claims, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(token)
+	}
+	return ts, sign
+}
+
+func TestParseIDToken_TrustedIssuer(t *testing.T) {
+	ts, sign := newTestIssuer(t)
+	c, err := NewClient(ts.Client(), 123456, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetOIDCIssuer(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddTrustedIssuer(ts.URL+"/octocorp", []string{"OctoCorp"}); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	newClaims := func(issuer, owner string) *jwt.Claims {
+		return &jwt.Claims{
+			Issuer:         issuer,
+			Subject:        "repo:" + owner + "/hello-world:ref:refs/heads/main",
+			Audience:       []string{"https://github-app.shogo82148.com/123456"},
+			IssuedAt:       now,
+			NotBefore:      now,
+			ExpirationTime: now.Add(5 * time.Minute),
+			Raw: map[string]any{
+				"repository":       owner + "/hello-world",
+				"repository_id":    "1296269",
+				"repository_owner": owner,
+			},
+		}
+	}
+
+	cases := []struct {
+		issuer string
+		owner  string
+		err    string
+	}{
+		{issuer: ts.URL, owner: "octocat"},
+		{issuer: ts.URL + "/octocorp", owner: "octocorp"},
+		{
+			issuer: ts.URL + "/octocorp",
+			owner:  "octocat",
+			err:    "is not trusted for octocat",
+		},
+		{
+			issuer: ts.URL + "/unknown",
+			owner:  "octocat",
+			err:    "invalid issuer",
+		},
+	}
+	for _, tc := range cases {
+		id, err := c.ParseIDToken(t.Context(), sign(newClaims(tc.issuer, tc.owner)))
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s for %s: unexpected error: %v", tc.issuer, tc.owner, err)
+				continue
+			}
+			if id.RepositoryOwner != tc.owner {
+				t.Errorf("%s for %s: unexpected owner: %q", tc.issuer, tc.owner, id.RepositoryOwner)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s for %s: want error %q, got %v", tc.issuer, tc.owner, tc.err, err)
+		}
+	}
+}
+
+func TestParseIDToken_CustomSubject(t *testing.T) {
+	ts, sign := newTestIssuer(t)
+	c, err := NewClient(ts.Client(), 123456, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetOIDCIssuer(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	newClaims := func(sub string, raw map[string]any) *jwt.Claims {
+		return &jwt.Claims{
+			Issuer:         ts.URL,
+			Subject:        sub,
+			Audience:       []string{"https://github-app.shogo82148.com/123456"},
+			IssuedAt:       now,
+			NotBefore:      now,
+			ExpirationTime: now.Add(5 * time.Minute),
+			Raw:            raw,
+		}
+	}
+
+	// the subject that customized by the template doesn't have the repository name.
+	id, err := c.ParseIDToken(t.Context(), sign(newClaims("repo_id:1296269:context:prod", map[string]any{
+		"repository":    "octocat/hello-world",
+		"repository_id": "1296269",
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Subject != "repo_id:1296269:context:prod" {
+		t.Errorf("unexpected subject: %q", id.Subject)
+	}
+
+	// the repository claims are required.
+	_, err = c.ParseIDToken(t.Context(), sign(newClaims("repo:octocat/hello-world:ref:refs/heads/main", map[string]any{
+		"repository": "octocat/hello-world",
+	})))
+	if err == nil || !strings.Contains(err.Error(), "the repository claims are missing") {
+		t.Errorf("want error, got %v", err)
+	}
+}
+
+func TestParseIDToken_Claims(t *testing.T) {
+	ts, sign := newTestIssuer(t)
+	c, err := NewClient(ts.Client(), 123456, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetOIDCIssuer(ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddTrustedIssuer(ts.URL+"/octo-enterprise", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// newToken re-signs the claims of the fixture with the test issuer.
+	newToken := func(path string) string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var raw map[string]any
+		if err := json.Unmarshal(data, &raw); err != nil {
+			t.Fatal(err)
+		}
+		iss := strings.Replace(raw["iss"].(string), oidcIssuer, ts.URL, 1)
+		sub := raw["sub"].(string)
+		jti := raw["jti"].(string)
+		for _, name := range []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti"} {
+			delete(raw, name)
+		}
+		now := time.Now()
+		return sign(&jwt.Claims{
+			Issuer:         iss,
+			Subject:        sub,
+			Audience:       []string{"https://github-app.shogo82148.com/123456"},
+			IssuedAt:       now,
+			NotBefore:      now,
+			ExpirationTime: now.Add(5 * time.Minute),
+			JWTID:          jti,
+			Raw:            raw,
+		})
+	}
+
+	cases := []struct {
+		path string
+		want *ActionsIDToken
+	}{
+		{
+			path: "testdata/id-token-claims.json",
+			want: &ActionsIDToken{
+				Environment:          "prod",
+				Ref:                  "refs/heads/main",
+				RefProtected:         "true",
+				SHA:                  "example-sha",
+				Repository:           "octo-org/octo-repo",
+				RepositoryOwner:      "octo-org",
+				ActorID:              "12",
+				RepositoryVisibility: "private",
+				RepositoryID:         "74",
+				RepositoryOwnerID:    "65",
+				RunID:                "example-run-id",
+				RunNumber:            "10",
+				RunAttempt:           "2",
+				RunnerEnvironment:    "github-hosted",
+				Actor:                "octocat",
+				Workflow:             "example-workflow",
+				WorkflowRef:          "octo-org/octo-repo/.github/workflows/deploy.yml@refs/heads/main",
+				WorkflowSHA:          "example-workflow-sha",
+				EventName:            "workflow_dispatch",
+				RefType:              "branch",
+				JobWorkflowRef:       "octo-org/octo-automation/.github/workflows/oidc.yml@refs/heads/main",
+				JobWorkflowSHA:       "example-job-workflow-sha",
+				CheckRunID:           "1234567890",
+			},
+		},
+		{
+			path: "testdata/id-token-claims-enterprise.json",
+			want: &ActionsIDToken{
+				Ref:                  "refs/pull/42/merge",
+				RefProtected:         "false",
+				SHA:                  "example-sha",
+				Repository:           "octo-corp/octo-repo",
+				RepositoryOwner:      "octo-corp",
+				ActorID:              "12",
+				RepositoryVisibility: "internal",
+				RepositoryID:         "74",
+				RepositoryOwnerID:    "66",
+				RunID:                "example-run-id",
+				RunNumber:            "11",
+				RunAttempt:           "1",
+				RunnerEnvironment:    "self-hosted",
+				Actor:                "octocat",
+				Workflow:             "CI",
+				WorkflowRef:          "octo-corp/octo-repo/.github/workflows/ci.yml@refs/pull/42/merge",
+				WorkflowSHA:          "example-workflow-sha",
+				HeadRef:              "feature",
+				BaseRef:              "main",
+				EventName:            "pull_request",
+				RefType:              "branch",
+				JobWorkflowRef:       "octo-corp/octo-repo/.github/workflows/ci.yml@refs/pull/42/merge",
+				JobWorkflowSHA:       "example-workflow-sha",
+				CheckRunID:           "1234567891",
+				Enterprise:           "octo-enterprise",
+				EnterpriseID:         "1",
+			},
+		},
+	}
+	for _, tc := range cases {
+		id, err := c.ParseIDToken(t.Context(), newToken(tc.path))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.path, err)
+			continue
+		}
+		if id.Claims == nil || id.JWTID != "example-id" {
+			t.Errorf("%s: the registered claims are not decoded: %#v", tc.path, id.Claims)
+		}
+		got := *id
+		got.Claims = nil
+		if !reflect.DeepEqual(&got, tc.want) {
+			t.Errorf("%s: unexpected claims:\nwant %#v\ngot  %#v", tc.path, tc.want, &got)
+		}
+	}
+}
+
+func TestPeekClaims(t *testing.T) {
+	token := func(payload string) string {
+		return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".signature"
+	}
+	cases := []struct {
+		token string
+		want  *UnverifiedClaims
+	}{
+		{
+			token: token(`{"iss":"https://token.actions.githubusercontent.com","aud":"https://github-app.shogo82148.com/123456"}`),
+			want: &UnverifiedClaims{
+				Issuer:   "https://token.actions.githubusercontent.com",
+				Audience: []string{"https://github-app.shogo82148.com/123456"},
+			},
+		},
+		{
+			token: token(`{"aud":["https://github.com/shogo82148","https://github-app.shogo82148.com/123456"]}`),
+			want: &UnverifiedClaims{
+				Audience: []string{"https://github.com/shogo82148", "https://github-app.shogo82148.com/123456"},
+			},
+		},
+		{
+			token: token(`{"iss":"https://token.actions.githubusercontent.com/octocorp"}`),
+			want: &UnverifiedClaims{
+				Issuer: "https://token.actions.githubusercontent.com/octocorp",
+			},
+		},
+	}
+	for i, c := range cases {
+		got, err := PeekClaims(c.token)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%d: want %#v, got %#v", i, c.want, got)
+		}
+	}
+
+	for _, token := range []string{"dummy-token", token(`{"aud":1}`), token(`{"iss":1}`), "a.!!!.c"} {
+		if _, err := PeekClaims(token); err == nil {
+			t.Errorf("%s: want error, got nil", token)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package githubapptoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+	"github.com/shogo82148/goat/jwk"
+)
+
+// ssmJWKSReloadInterval is the interval to reload the JWK Set from Systems Manager Parameter Store.
+const ssmJWKSReloadInterval = 5 * time.Minute
+
+// ssmService is a subset of AWS Systems Manager client interface.
+type ssmService interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// ssmJWKSLoader loads the JWK Set from a Systems Manager parameter.
+type ssmJWKSLoader struct {
+	svc  ssmService
+	name string
+}
+
+func (l *ssmJWKSLoader) LoadJWKS(ctx context.Context) (*jwk.Set, time.Duration, error) {
+	out, err := l.svc.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(l.name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get the JWK Set: %w", err)
+	}
+	set, err := jwk.ParseSet([]byte(aws.ToString(out.Parameter.Value)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid JWK Set in %s: %w", l.name, err)
+	}
+	return set, ssmJWKSReloadInterval, nil
+}
+
+// newJWKSLoader returns the loader of the static JWK Set in the file or the Systems Manager parameter.
+// It returns nil if both are empty, and the JWK Set is discovered from the issuer.
+func newJWKSLoader(file, param string, svc ssmService) (github.JWKSLoader, error) {
+	switch {
+	case file != "" && param == "":
+		return github.NewFileJWKSLoader(file), nil
+	case file == "" && param != "":
+		return &ssmJWKSLoader{svc: svc, name: param}, nil
+	case file == "" && param == "":
+		return nil, nil
+	default:
+		return nil, errors.New("only one of jwks_file and jwks_parameter can be set")
+	}
+}
@@ -0,0 +1,79 @@
+package githubapptoken
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+type ssmServiceMock struct {
+	GetParameterFunc func(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+func (m *ssmServiceMock) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	return m.GetParameterFunc(ctx, params, optFns...)
+}
+
+func TestSSMJWKSLoader(t *testing.T) {
+	data, err := os.ReadFile("github/testdata/jwks.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &ssmServiceMock{
+		GetParameterFunc: func(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+			switch aws.ToString(params.Name) {
+			case "/github-app-token/jwks":
+				return &ssm.GetParameterOutput{
+					Parameter: &types.Parameter{Value: aws.String(string(data))},
+				}, nil
+			case "/github-app-token/invalid-jwks":
+				return &ssm.GetParameterOutput{
+					Parameter: &types.Parameter{Value: aws.String("{")},
+				}, nil
+			}
+			return nil, errors.New("parameter not found")
+		},
+	}
+
+	loader, err := newJWKSLoader("", "/github-app-token/jwks", svc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, ttl, err := loader.LoadJWKS(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := set.Find("test-key"); !ok {
+		t.Error("the key is not found")
+	}
+	if ttl != ssmJWKSReloadInterval {
+		t.Errorf("unexpected ttl: %s", ttl)
+	}
+
+	for _, name := range []string{"/github-app-token/invalid-jwks", "/github-app-token/unknown"} {
+		loader, err := newJWKSLoader("", name, svc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := loader.LoadJWKS(context.Background()); err == nil {
+			t.Errorf("%s: want error, but not", name)
+		}
+	}
+}
+
+func TestNewJWKSLoader(t *testing.T) {
+	if loader, err := newJWKSLoader("", "", nil); err != nil || loader != nil {
+		t.Errorf("want nil loader, got %v, %v", loader, err)
+	}
+	if loader, err := newJWKSLoader("github/testdata/jwks.json", "", nil); err != nil || loader == nil {
+		t.Errorf("want the file loader, got %v, %v", loader, err)
+	}
+	if _, err := newJWKSLoader("github/testdata/jwks.json", "/github-app-token/jwks", nil); err == nil {
+		t.Error("want error, but not")
+	}
+}
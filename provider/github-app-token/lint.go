@@ -0,0 +1,253 @@
+package githubapptoken
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+	"github.com/shogo82148/goat/jwt"
+)
+
+// Decision is the decision of the policies for a repository.
+type Decision = repositoryDecision
+
+// IsOrgPolicy reports whether the file is the organization policy, .github/org-actions.yaml.
+func IsOrgPolicy(name string) bool {
+	base := path.Base(strings.ReplaceAll(name, `\`, "/"))
+	return base == "org-actions.yaml" || base == "org-actions.yml"
+}
+
+// LintPolicy checks the policy file in the same way as the provider does.
+// name is the path of the file, that decides the kind of the policy.
+// In addition, it reports the malformed node IDs, that the provider silently ignores.
+func LintPolicy(name string, data []byte) error {
+	if IsOrgPolicy(name) {
+		config, err := parseOrgPolicy(data)
+		if err != nil {
+			return err
+		}
+		return errors.Join(
+			lintRules("repositories", config.Repositories),
+			lintRules("deny", config.Deny),
+			lintRules("organization", config.Organization),
+		)
+	}
+
+	config, err := parsePolicy(data)
+	if err != nil {
+		return err
+	}
+	return lintRules("repositories", config.Repositories)
+}
+
+func lintRules(section string, rules []*repositoryRule) error {
+	var errs []error
+	for i, rule := range rules {
+		if rule.Repository == "" || strings.Contains(rule.Repository, "/") {
+			continue
+		}
+		if !isRepositoryNodeID(rule.Repository) {
+			errs = append(errs, fmt.Errorf("%s[%d]: invalid node id of the repository: %q", section, i, rule.Repository))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isRepositoryNodeID reports whether id looks like a global node id of a repository.
+// https://docs.github.com/en/graphql/guides/using-global-node-ids
+func isRepositoryNodeID(id string) bool {
+	// the new format, such as "R_kgDOF8HFZg".
+	if rest, ok := strings.CutPrefix(id, "R_"); ok {
+		if rest == "" {
+			return false
+		}
+		for _, r := range rest {
+			if !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '-' || r == '_') {
+				return false
+			}
+		}
+		return true
+	}
+
+	// the legacy format, such as "MDEwOlJlcG9zaXRvcnkzOTg1NzQ5NTA=" ("010:Repository398574950").
+	data, err := base64.StdEncoding.DecodeString(id)
+	if err != nil {
+		return false
+	}
+	_, kind, ok := strings.Cut(string(data), ":")
+	return ok && strings.HasPrefix(kind, "Repository")
+}
+
+// PolicySimulation is the input of SimulatePolicy.
+type PolicySimulation struct {
+	// Policy is the content of .github/actions.yaml of the target repository.
+	// nil means that the repository has no policy file.
+	Policy []byte
+
+	// OrgPolicy is the content of .github/org-actions.yaml of the owner of the target repository.
+	// nil means that the owner has no organization policy.
+	OrgPolicy []byte
+
+	// Target is the full name of the target repository, such as "shogo82148/docs".
+	// If it is empty or the repository that requests the token, the self rules are evaluated.
+	Target string
+
+	// Claims is the JSON of the claims of the OIDC token.
+	Claims []byte
+
+	// Request is the JSON of the request body. It may be nil.
+	Request []byte
+
+	// NodeID is the global node id of the repository that requests the token.
+	// The rules with node ids match only if it is set.
+	NodeID string
+}
+
+// SimulatePolicy evaluates the policies offline, and explains the decision as the dry run does.
+// The names in the policies are resolved using only the claims,
+// so the rules with the names of other repositories don't match.
+func SimulatePolicy(ctx context.Context, sim *PolicySimulation) (*Decision, error) {
+	id, err := decodeClaims(sim.Claims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid claims: %w", err)
+	}
+	repoID, err := strconv.ParseUint(id.RepositoryID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository id in the claims: %w", err)
+	}
+	ownerID, err := strconv.ParseUint(id.RepositoryOwnerID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository owner id in the claims: %w", err)
+	}
+	var body requestBody
+	if sim.Request != nil {
+		if err := json.Unmarshal(sim.Request, &body); err != nil {
+			return nil, fmt.Errorf("invalid request body: %w", err)
+		}
+	}
+
+	target := sim.Target
+	if target == "" {
+		target = id.Repository
+	}
+	owner, name, err := splitOwnerRepo(target)
+	if err != nil {
+		return nil, err
+	}
+	self := strings.EqualFold(target, id.Repository)
+
+	decision := &Decision{
+		Repository: target,
+		Rules:      []*ruleDecision{},
+	}
+	req := &policyRequest{
+		From: &callerRepository{
+			NodeID:  sim.NodeID,
+			ID:      repoID,
+			OwnerID: ownerID,
+			Claims:  id,
+		},
+		Target: &targetRepository{
+			Owner: owner,
+			Name:  name,
+		},
+		Permissions: body.Permissions.toPermissionSet(),
+		explain:     decision,
+	}
+	if self {
+		req.Target.ID = repoID
+	}
+
+	var repo *policyConfig
+	if sim.Policy != nil {
+		repo, err = parsePolicy(sim.Policy)
+		if err != nil {
+			return nil, policyError(owner, name, err)
+		}
+		repo.source = target + "/.github/actions.yaml"
+	}
+	var org *orgPolicyConfig
+	if sim.OrgPolicy != nil && !self {
+		org, err = parseOrgPolicy(sim.OrgPolicy)
+		if err != nil {
+			return nil, policyError(owner, ".github", err)
+		}
+		org.source = owner + "/.github/.github/org-actions.yaml"
+	}
+
+	resolver := &claimsResolver{id: id, repo: repoID, owner: ownerID}
+	var ceiling permissionSet
+	var ok bool
+	switch {
+	case self && repo == nil:
+		ok = true
+	case self:
+		ceiling, ok, err = repo.selfGrant(ctx, req)
+	case repo == nil && org == nil:
+		err = errors.New("config file is not found")
+	default:
+		ceiling, ok, err = evaluatePolicies(ctx, org, repo, req, resolver)
+	}
+	if err == nil && !ok {
+		err = errors.New("permission denied")
+	}
+	if err == nil {
+		_, err = clampPermissions(ceiling, nil, body.Permissions)
+		var forbidden *forbiddenError
+		if errors.As(err, &forbidden) {
+			err = forbidden.err
+		}
+	}
+	decision.finish(ceiling, err)
+	return decision, nil
+}
+
+// decodeClaims decodes the JSON of the claims of the OIDC token.
+func decodeClaims(data []byte) (*github.ActionsIDToken, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw map[string]any
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	claims := &jwt.Claims{Raw: raw}
+	claims.Issuer, _ = raw["iss"].(string)
+	claims.Subject, _ = raw["sub"].(string)
+	claims.JWTID, _ = raw["jti"].(string)
+	var id github.ActionsIDToken
+	if err := claims.DecodeCustom(&id); err != nil {
+		return nil, err
+	}
+	id.Claims = claims
+	return &id, nil
+}
+
+// claimsResolver resolves the names in the policies using only the claims of the OIDC token.
+// It resolves the repository that requests the token and its owner, and nothing else.
+type claimsResolver struct {
+	id    *github.ActionsIDToken
+	repo  uint64
+	owner uint64
+}
+
+func (r *claimsResolver) repositoryID(ctx context.Context, owner, repo string) (uint64, error) {
+	if strings.EqualFold(owner+"/"+repo, r.id.Repository) {
+		return r.repo, nil
+	}
+	return 0, nil
+}
+
+func (r *claimsResolver) ownerID(ctx context.Context, owner string) (uint64, error) {
+	if strings.EqualFold(owner, r.id.RepositoryOwner) {
+		return r.owner, nil
+	}
+	return 0, nil
+}
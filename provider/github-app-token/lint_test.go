@@ -0,0 +1,186 @@
+package githubapptoken
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLintPolicy(t *testing.T) {
+	cases := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{
+			name: ".github/actions.yaml",
+			content: "repositories:\n" +
+				"  - R_kgDOF8HFZg\n" +
+				"  - MDEwOlJlcG9zaXRvcnkzOTg1NzQ5NTA=\n" +
+				"  - shogo82148/*\n" +
+				"self:\n" +
+				"  - ref: refs/heads/main\n",
+		},
+		{
+			name: ".github/actions.yaml",
+			content: "repositories:\n" +
+				"  - repository: R_kgDOF8HFZg\n" +
+				"    permission:\n" +
+				"      contents: read\n",
+			err: `unknown field "permission"`,
+		},
+		{
+			name: ".github/actions.yaml",
+			content: "repositories:\n" +
+				"  - R_kgDOF8HFZg\n" +
+				"  - shogo82148-actions-github-app-token\n",
+			err: `repositories[1]: invalid node id of the repository: "shogo82148-actions-github-app-token"`,
+		},
+		{
+			name: ".github/actions.yaml",
+			content: "repositories:\n" +
+				"  - repository: R_kgDOF8HFZg\n" +
+				"    permissions:\n" +
+				"      contents: execute\n",
+			err: `invalid access level for contents: "execute"`,
+		},
+		{
+			name: ".github/org-actions.yml",
+			content: "deny:\n" +
+				"  - event_name: pull_request_target\n" +
+				"  - repository: R_kgDOF8HFZ!\n",
+			err: `deny[1]: invalid node id of the repository: "R_kgDOF8HFZ!"`,
+		},
+		{
+			name: ".github/org-actions.yaml",
+			content: "denny:\n" +
+				"  - event_name: pull_request_target\n",
+			err: `unknown field "denny"`,
+		},
+	}
+
+	for i, c := range cases {
+		err := LintPolicy(c.name, []byte(c.content))
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%d: want error %q, got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestSimulatePolicy(t *testing.T) {
+	claims := []byte(`{
+		"iss": "https://token.actions.githubusercontent.com",
+		"sub": "repo:shogo82148/actions-github-app-token:ref:refs/heads/main",
+		"repository": "shogo82148/actions-github-app-token",
+		"repository_id": "398574950",
+		"repository_owner": "shogo82148",
+		"repository_owner_id": "1157344",
+		"ref": "refs/heads/main",
+		"event_name": "push"
+	}`)
+	policy := []byte("repositories:\n" +
+		"  - repository: shogo82148/actions-github-app-token\n" +
+		"    event_name: pull_request\n" +
+		"    permissions:\n" +
+		"      contents: write\n" +
+		"  - repository: shogo82148/*\n" +
+		"    condition: claims.ref == \"refs/heads/main\"\n" +
+		"    permissions:\n" +
+		"      contents: read\n" +
+		"self:\n" +
+		"  - ref: refs/heads/main\n" +
+		"    permissions:\n" +
+		"      issues: write\n")
+
+	t.Run("target", func(t *testing.T) {
+		got, err := SimulatePolicy(context.Background(), &PolicySimulation{
+			Policy: policy,
+			Target: "shogo82148/docs",
+			Claims: claims,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &Decision{
+			Repository:  "shogo82148/docs",
+			Allowed:     true,
+			Permissions: permissionSet{"contents": "read"},
+			Rules: []*ruleDecision{
+				{
+					Policy:      "shogo82148/docs/.github/actions.yaml",
+					Rule:        "repositories[0]",
+					Reason:      `event_name "push" doesn't match`,
+					Permissions: permissionSet{"contents": "write"},
+				},
+				{
+					Policy:      "shogo82148/docs/.github/actions.yaml",
+					Rule:        "repositories[1]",
+					Matched:     true,
+					Permissions: permissionSet{"contents": "read"},
+				},
+			},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected decision: want %#v, got %#v", want, got)
+		}
+	})
+
+	t.Run("over the ceiling", func(t *testing.T) {
+		got, err := SimulatePolicy(context.Background(), &PolicySimulation{
+			Policy:  policy,
+			Target:  "shogo82148/docs",
+			Claims:  claims,
+			Request: []byte(`{"permissions": {"contents": "write"}}`),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Allowed {
+			t.Error("want denied, got allowed")
+		}
+		if got.Error != "contents: write is not allowed, up to read" {
+			t.Errorf("unexpected error: %q", got.Error)
+		}
+	})
+
+	t.Run("self", func(t *testing.T) {
+		got, err := SimulatePolicy(context.Background(), &PolicySimulation{
+			Policy: policy,
+			Claims: claims,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Allowed {
+			t.Errorf("want allowed, got %q", got.Error)
+		}
+		if want := (permissionSet{"issues": "write"}); !reflect.DeepEqual(got.Permissions, want) {
+			t.Errorf("unexpected permissions: want %v, got %v", want, got.Permissions)
+		}
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		got, err := SimulatePolicy(context.Background(), &PolicySimulation{
+			Policy:    policy,
+			OrgPolicy: []byte("deny:\n  - event_name: push\n"),
+			Target:    "shogo82148/docs",
+			Claims:    claims,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Allowed {
+			t.Error("want denied, got allowed")
+		}
+		if len(got.Rules) != 1 || got.Rules[0].Rule != "deny[0]" || !got.Rules[0].Matched {
+			t.Errorf("unexpected rules: %#v", got.Rules)
+		}
+	})
+}
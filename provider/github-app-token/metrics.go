@@ -0,0 +1,39 @@
+package githubapptoken
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+)
+
+// metricsNamespace is the namespace of the CloudWatch metrics.
+const metricsNamespace = "GitHubAppToken"
+
+// observeJWKS records the refreshes of the JWK Sets as CloudWatch metrics.
+// The log lines are in the Embedded Metric Format, so CloudWatch Logs extracts the metrics from them.
+// The cache hits are not recorded, because they are as many as the requests.
+func observeJWKS(ctx context.Context, issuer string, event github.JWKSEvent) {
+	if event == github.JWKSCacheHit {
+		return
+	}
+	slog.InfoContext(
+		ctx, "the JWK Set cache",
+		slog.Any("_aws", map[string]any{
+			"Timestamp": time.Now().UnixMilli(),
+			"CloudWatchMetrics": []any{
+				map[string]any{
+					"Namespace":  metricsNamespace,
+					"Dimensions": [][]string{{"Event"}, {"Issuer", "Event"}},
+					"Metrics": []any{
+						map[string]any{"Name": "JWKSRefresh", "Unit": "Count"},
+					},
+				},
+			},
+		}),
+		slog.String("Issuer", issuer),
+		slog.String("Event", string(event)),
+		slog.Int("JWKSRefresh", 1),
+	)
+}
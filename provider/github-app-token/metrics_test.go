@@ -0,0 +1,52 @@
+package githubapptoken
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+)
+
+func TestObserveJWKS(t *testing.T) {
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	observeJWKS(context.Background(), "https://token.actions.githubusercontent.com", github.JWKSCacheHit)
+	if buf.Len() != 0 {
+		t.Errorf("the cache hit is logged: %s", buf.String())
+	}
+
+	observeJWKS(context.Background(), "https://token.actions.githubusercontent.com", github.JWKSRefreshUnknownKID)
+	var got struct {
+		AWS struct {
+			Timestamp         int64 `json:"Timestamp"`
+			CloudWatchMetrics []struct {
+				Namespace  string     `json:"Namespace"`
+				Dimensions [][]string `json:"Dimensions"`
+				Metrics    []struct {
+					Name string `json:"Name"`
+				} `json:"Metrics"`
+			} `json:"CloudWatchMetrics"`
+		} `json:"_aws"`
+		Issuer      string `json:"Issuer"`
+		Event       string `json:"Event"`
+		JWKSRefresh int    `json:"JWKSRefresh"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.AWS.Timestamp == 0 || len(got.AWS.CloudWatchMetrics) != 1 {
+		t.Fatalf("invalid metadata: %s", buf.String())
+	}
+	m := got.AWS.CloudWatchMetrics[0]
+	if m.Namespace != metricsNamespace || len(m.Metrics) != 1 || m.Metrics[0].Name != "JWKSRefresh" {
+		t.Errorf("unexpected metric: %s", buf.String())
+	}
+	if got.Issuer != "https://token.actions.githubusercontent.com" || got.Event != "refresh_unknown_kid" || got.JWKSRefresh != 1 {
+		t.Errorf("unexpected values: %s", buf.String())
+	}
+}
@@ -0,0 +1,219 @@
+package githubapptoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/goccy/go-yaml"
+)
+
+// operatorPolicy is the policy of the operator of the provider.
+// It applies to all requests before the policies in the repositories.
+//
+//	# the owners that can use the app. empty means any owner.
+//	owners:
+//	  - shogo82148
+//
+//	# the repositories that can't use the app, nor be accessed by the tokens.
+//	deny:
+//	  - shogo82148/secret-*
+//
+//	# the maximum permissions for the repositories of each owner.
+//	# "*" is for the owners that are not listed.
+//	permissions:
+//	  shogo82148:
+//	    contents: write
+//	  "*":
+//	    contents: read
+//
+//	# the permissions that are never granted.
+//	banned_permissions:
+//	  - administration
+type operatorPolicy struct {
+	// Owners is the list of the owners that can use the app.
+	// Empty means that any owner can use it.
+	Owners []string `yaml:"owners"`
+
+	// Deny is the list of the patterns of the repositories that can't use the app.
+	// The patterns are in the syntax of [path.Match], such as "owner/*".
+	Deny []string `yaml:"deny"`
+
+	// Permissions is the maximum permissions for the repositories of each owner.
+	Permissions map[string]permissionSet `yaml:"permissions"`
+
+	// BannedPermissions is the list of the permissions that are never granted.
+	BannedPermissions []string `yaml:"banned_permissions"`
+}
+
+// parseOperatorPolicy parses the operator policy.
+func parseOperatorPolicy(data []byte) (*operatorPolicy, error) {
+	var policy operatorPolicy
+	if err := yaml.UnmarshalWithOptions(data, &policy, yaml.Strict()); err != nil {
+		return nil, err
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+func (p *operatorPolicy) validate() error {
+	for i, pattern := range p.Deny {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("deny[%d]: invalid pattern %q: %w", i, pattern, err)
+		}
+	}
+
+	// GitHub treats the names as case-insensitive.
+	permissions := make(map[string]permissionSet, len(p.Permissions))
+	for owner, set := range p.Permissions {
+		if err := set.validate(); err != nil {
+			return fmt.Errorf("permissions.%s: %w", owner, err)
+		}
+		permissions[strings.ToLower(owner)] = set
+	}
+	p.Permissions = permissions
+
+	for i, name := range p.BannedPermissions {
+		if _, ok := permissionNames[name]; !ok {
+			return fmt.Errorf("banned_permissions[%d]: unknown permission: %q", i, name)
+		}
+	}
+	return nil
+}
+
+// loadOperatorPolicy loads the operator policy from the environment variables:
+//
+//   - GITHUB_APP_POLICY: the content of the policy.
+//   - GITHUB_APP_POLICY_FILE: the path of the policy file.
+//   - GITHUB_APP_POLICY_PARAMETER: the name of the Systems Manager parameter whose value is the policy.
+//
+// It returns nil if none of them is set.
+func loadOperatorPolicy(ctx context.Context, svc *ssm.Client) (*operatorPolicy, error) {
+	content := os.Getenv("GITHUB_APP_POLICY")
+	file := os.Getenv("GITHUB_APP_POLICY_FILE")
+	param := os.Getenv("GITHUB_APP_POLICY_PARAMETER")
+
+	var data []byte
+	switch {
+	case content != "" && file == "" && param == "":
+		data = []byte(content)
+	case content == "" && file != "" && param == "":
+		var err error
+		data, err = os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the operator policy: %w", err)
+		}
+	case content == "" && file == "" && param != "":
+		out, err := svc.GetParameter(ctx, &ssm.GetParameterInput{
+			Name:           aws.String(param),
+			WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the operator policy: %w", err)
+		}
+		data = []byte(aws.ToString(out.Parameter.Value))
+	case content == "" && file == "" && param == "":
+		return nil, nil
+	default:
+		return nil, errors.New("only one of GITHUB_APP_POLICY, GITHUB_APP_POLICY_FILE, and GITHUB_APP_POLICY_PARAMETER can be set")
+	}
+
+	policy, err := parseOperatorPolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid operator policy: %w", err)
+	}
+	return policy, nil
+}
+
+// check checks that the repository can use the app.
+// fullName is the full name of the repository, such as "shogo82148/actions-github-app-token".
+func (p *operatorPolicy) check(fullName string) error {
+	if p == nil {
+		return nil
+	}
+	owner, _, _ := strings.Cut(fullName, "/")
+	if len(p.Owners) > 0 && !containsFold(p.Owners, owner) {
+		return fmt.Errorf("the owner %s is not allowed by the operator", owner)
+	}
+	name := strings.ToLower(fullName)
+	for _, pattern := range p.Deny {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return fmt.Errorf("the repository %s is denied by the operator", fullName)
+		}
+	}
+	return nil
+}
+
+// checkOrganization checks that the tokens can access all repositories of the owner.
+// The organization scope is not allowed if the operator denies some of them,
+// because the repositories of the owner are unknown until the token is issued.
+func (p *operatorPolicy) checkOrganization(owner string) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.Owners) > 0 && !containsFold(p.Owners, owner) {
+		return fmt.Errorf("the owner %s is not allowed by the operator", owner)
+	}
+	name := strings.ToLower(owner)
+	for _, pattern := range p.Deny {
+		patternOwner, _, _ := strings.Cut(strings.ToLower(pattern), "/")
+		if matched, _ := path.Match(patternOwner, name); matched {
+			return fmt.Errorf("the organization scope is not allowed for %s, because the operator denies some of its repositories", owner)
+		}
+	}
+	return nil
+}
+
+// ceiling returns the maximum permissions for the repositories of the owner.
+// nil means no restriction.
+func (p *operatorPolicy) ceiling(owner string) permissionSet {
+	if p == nil {
+		return nil
+	}
+	if set, ok := p.Permissions[strings.ToLower(owner)]; ok {
+		return set
+	}
+	return p.Permissions["*"]
+}
+
+// ban removes the banned permissions from the ceiling.
+// If the ceiling is nil, the banned permissions are removed from the permissions of the installation.
+// The permissions of the installation that this API doesn't know, such as the ones that GitHub adds later,
+// are removed too, because they can't be requested.
+func (p *operatorPolicy) ban(ceiling, installed permissionSet) (permissionSet, error) {
+	if p == nil || len(p.BannedPermissions) == 0 {
+		return ceiling, nil
+	}
+	if ceiling == nil {
+		if installed == nil {
+			return nil, errors.New("the permissions of the installation are unknown")
+		}
+		ceiling = installed
+	}
+	ret := make(permissionSet, len(ceiling))
+	for name, level := range ceiling {
+		if _, ok := permissionNames[name]; !ok {
+			continue
+		}
+		if !containsFold(p.BannedPermissions, name) {
+			ret[name] = level
+		}
+	}
+	return ret, nil
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package githubapptoken
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseOperatorPolicy(t *testing.T) {
+	policy, err := parseOperatorPolicy([]byte("owners:\n" +
+		"  - shogo82148\n" +
+		"deny:\n" +
+		"  - shogo82148/secret-*\n" +
+		"permissions:\n" +
+		"  Shogo82148:\n" +
+		"    contents: write\n" +
+		"  \"*\":\n" +
+		"    contents: read\n" +
+		"banned_permissions:\n" +
+		"  - administration\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &operatorPolicy{
+		Owners: []string{"shogo82148"},
+		Deny:   []string{"shogo82148/secret-*"},
+		Permissions: map[string]permissionSet{
+			"shogo82148": {"contents": "write"},
+			"*":          {"contents": "read"},
+		},
+		BannedPermissions: []string{"administration"},
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("unexpected policy: want %#v, got %#v", want, policy)
+	}
+}
+
+func TestParseOperatorPolicy_Invalid(t *testing.T) {
+	cases := []struct {
+		content string
+		err     string
+	}{
+		{
+			content: "owner:\n  - shogo82148\n",
+			err:     `unknown field "owner"`,
+		},
+		{
+			content: "deny:\n  - shogo82148/[\n",
+			err:     "deny[0]: invalid pattern",
+		},
+		{
+			content: "permissions:\n  shogo82148:\n    contents: execute\n",
+			err:     `permissions.shogo82148: invalid access level for contents: "execute"`,
+		},
+		{
+			content: "banned_permissions:\n  - administrator\n",
+			err:     `banned_permissions[0]: unknown permission: "administrator"`,
+		},
+	}
+	for i, c := range cases {
+		_, err := parseOperatorPolicy([]byte(c.content))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%d: want error %q, got %v", i, c.err, err)
+		}
+	}
+}
+
+func TestOperatorPolicy_Check(t *testing.T) {
+	policy := &operatorPolicy{
+		Owners: []string{"shogo82148", "fuller-inc"},
+		Deny:   []string{"shogo82148/secret-*"},
+	}
+	cases := []struct {
+		repository string
+		err        string
+	}{
+		{repository: "shogo82148/actions-github-app-token"},
+		{repository: "Fuller-Inc/actions"},
+		{
+			repository: "octocat/hello-world",
+			err:        "the owner octocat is not allowed by the operator",
+		},
+		{
+			repository: "shogo82148/Secret-Repo",
+			err:        "the repository shogo82148/Secret-Repo is denied by the operator",
+		},
+	}
+	for _, c := range cases {
+		err := policy.check(c.repository)
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.repository, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%s: want error %q, got %v", c.repository, c.err, err)
+		}
+	}
+
+	// nil policy allows any repository.
+	var nilPolicy *operatorPolicy
+	if err := nilPolicy.check("octocat/hello-world"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestOperatorPolicy_CheckOrganization(t *testing.T) {
+	policy := &operatorPolicy{
+		Owners: []string{"shogo82148", "fuller-inc", "octocorp"},
+		Deny:   []string{"shogo82148/secret-*", "octo*/private"},
+	}
+	cases := []struct {
+		owner string
+		err   string
+	}{
+		{owner: "fuller-inc"},
+		{
+			owner: "octocat",
+			err:   "the owner octocat is not allowed by the operator",
+		},
+		{
+			owner: "Shogo82148",
+			err:   "the organization scope is not allowed for Shogo82148, because the operator denies some of its repositories",
+		},
+		{
+			owner: "octocorp",
+			err:   "the organization scope is not allowed for octocorp, because the operator denies some of its repositories",
+		},
+	}
+	for _, c := range cases {
+		err := policy.checkOrganization(c.owner)
+		if c.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", c.owner, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%s: want error %q, got %v", c.owner, c.err, err)
+		}
+	}
+}
+
+func TestOperatorPolicy_Ceiling(t *testing.T) {
+	policy := &operatorPolicy{
+		Permissions: map[string]permissionSet{
+			"shogo82148": {"contents": "write"},
+			"*":          {"contents": "read"},
+		},
+		BannedPermissions: []string{"administration"},
+	}
+	if got, want := policy.ceiling("Shogo82148"), (permissionSet{"contents": "write"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected ceiling: want %v, got %v", want, got)
+	}
+	if got, want := policy.ceiling("octocat"), (permissionSet{"contents": "read"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected ceiling: want %v, got %v", want, got)
+	}
+
+	got, err := policy.ban(nil, permissionSet{"administration": "write", "contents": "write", "new_permission": "read"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (permissionSet{"contents": "write"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected permissions: want %v, got %v", want, got)
+	}
+	got, err = policy.ban(permissionSet{"administration": "read", "issues": "write"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (permissionSet{"issues": "write"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected permissions: want %v, got %v", want, got)
+	}
+	if _, err := policy.ban(nil, nil); err == nil {
+		t.Error("want error, got nil")
+	}
+}
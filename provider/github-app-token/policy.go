@@ -0,0 +1,900 @@
+package githubapptoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+)
+
+// policyConfig is the content of .github/actions.yaml.
+type policyConfig struct {
+	// Repositories is the list of repositories that are allowed to access the repository.
+	Repositories []*repositoryRule `yaml:"repositories"`
+
+	// Self is the list of rules for the tokens that the workflows of the repository receive for itself.
+	// The rules have no repository.
+	// If it is nil, the workflows can receive any permissions the app has.
+	Self []*repositoryRule `yaml:"self"`
+
+	// source is the location of the policy file, such as "owner/repo/.github/actions.yaml".
+	// It is used to explain the decisions.
+	source string
+}
+
+// repositoryRule is an entry of the repositories list in .github/actions.yaml.
+// The repository is specified by its global node id, its "owner/name",
+// or a glob pattern such as "owner/service-*".
+// The entry is either a bare repository:
+//
+//	repositories:
+//	  - R_kgDOF8HFZg
+//
+// or a mapping with the maximum permissions the repository may receive:
+//
+//	repositories:
+//	  - repository: R_kgDOF8HFZg
+//	    permissions:
+//	      contents: read
+//	      pull_requests: write
+//
+// The mapping may have conditions on the claims of the OIDC token:
+//
+//	repositories:
+//	  - repository: R_kgDOF8HFZg
+//	    ref: refs/heads/main
+//	    environment: production
+//	    event_name: "!pull_request"
+//
+// A rule without repository trusts a reusable workflow, no matter which repository calls it.
+// It must have job_workflow_ref that names the repository of the workflow, and may pin its commit:
+//
+//	repositories:
+//	  - job_workflow_ref: my-org/ci/.github/workflows/release.yml@refs/heads/main
+//	    job_workflow_sha: 3c1e0c6f8c7f4c1a9d5c1b5f0a8e6c4d2b1a0f9e
+//
+// and an expression for the long tail of the conditions:
+//
+//	repositories:
+//	  - repository: R_kgDOF8HFZg
+//	    condition: claims.actor != "dependabot[bot]" && claims.ref.startsWith("refs/tags/v")
+type repositoryRule struct {
+	// Repository is the global node id, the full name, or the pattern of the repository.
+	// It may be empty if the rule trusts a reusable workflow by Conditions.JobWorkflowRef.
+	Repository string `yaml:"repository"`
+
+	// Permissions is the maximum permissions.
+	// nil means that the repository can receive any permissions the app has.
+	Permissions permissionSet `yaml:"permissions"`
+
+	// Conditions are the conditions on the claims of the OIDC token.
+	Conditions claimConditions `yaml:",inline"`
+
+	// Condition is an expression in the Common Expression Language (CEL).
+	// The rule matches only if it evaluates to true.
+	Condition string `yaml:"condition"`
+
+	condition *condition
+}
+
+func (r *repositoryRule) UnmarshalYAML(unmarshal func(any) error) error {
+	var repository string
+	if err := unmarshal(&repository); err == nil {
+		*r = repositoryRule{Repository: repository}
+		return nil
+	}
+
+	type plain repositoryRule
+	var rule plain
+	if err := unmarshal(&rule); err != nil {
+		return err
+	}
+	*r = repositoryRule(rule)
+	return nil
+}
+
+// parsePolicy parses .github/actions.yaml.
+func parsePolicy(data []byte) (*policyConfig, error) {
+	var config policyConfig
+	if err := yaml.UnmarshalWithOptions(data, &config, yaml.Strict()); err != nil {
+		// the unknown keys are rejected, because a misspelled condition would widen the rule.
+		return nil, &validationError{
+			message: err.Error(),
+			err:     err,
+		}
+	}
+	if err := config.validate(); err != nil {
+		return nil, &validationError{
+			message: err.Error(),
+			err:     err,
+		}
+	}
+	return &config, nil
+}
+
+func (c *policyConfig) validate() error {
+	if err := validateGrantRules("repositories", c.Repositories); err != nil {
+		return err
+	}
+	for i, rule := range c.Self {
+		if rule == nil {
+			return fmt.Errorf("self[%d]: rule is required", i)
+		}
+		if rule.Repository != "" {
+			return fmt.Errorf("self[%d]: repository is not allowed in self rules", i)
+		}
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("self[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validateGrantRules validates the rules that grant the access to the repositories that they name.
+func validateGrantRules(section string, rules []*repositoryRule) error {
+	for i, rule := range rules {
+		if rule == nil {
+			return fmt.Errorf("%s[%d]: rule is required", section, i)
+		}
+		if rule.Repository == "" {
+			if len(rule.Conditions.JobWorkflowRef) == 0 {
+				return fmt.Errorf("%s[%d]: repository or job_workflow_ref is required", section, i)
+			}
+			if err := validateJobWorkflowRef(rule.Conditions.JobWorkflowRef); err != nil {
+				return fmt.Errorf("%s[%d]: %w", section, i, err)
+			}
+		}
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("%s[%d]: %w", section, i, err)
+		}
+	}
+	return nil
+}
+
+// compile validates the rule and compiles its condition.
+func (r *repositoryRule) compile() error {
+	if r.Repository != "" {
+		if err := validateRepository(r.Repository); err != nil {
+			return err
+		}
+	}
+	if err := r.Permissions.validate(); err != nil {
+		return err
+	}
+	if err := r.Conditions.validate(); err != nil {
+		return err
+	}
+	if r.Condition != "" {
+		cond, err := compileCondition(r.Condition)
+		if err != nil {
+			return &validationError{
+				message: fmt.Sprintf("invalid condition %q: %v", r.Condition, err),
+				err:     err,
+			}
+		}
+		r.condition = cond
+	}
+	return nil
+}
+
+// callerRepository is the repository that requests the token.
+type callerRepository struct {
+	// NodeID is the global node id of the repository.
+	NodeID string
+
+	// ID is the id of the repository.
+	ID uint64
+
+	// OwnerID is the id of the owner of the repository.
+	OwnerID uint64
+
+	// Claims is the OIDC token of the workflow.
+	Claims *github.ActionsIDToken
+}
+
+// targetRepository is the repository that the token will access.
+type targetRepository struct {
+	ID    uint64
+	Owner string
+	Name  string
+}
+
+// policyRequest is the request that the policies are evaluated against.
+type policyRequest struct {
+	// From is the repository that requests the token.
+	From *callerRepository
+
+	// Target is the repository that the token will access.
+	Target *targetRepository
+
+	// Permissions is the requested permissions.
+	// nil means that the workflow requests no specific permissions.
+	Permissions permissionSet
+
+	// explain records the evaluation of the rules in the dry run.
+	// nil means that the evaluation is not recorded.
+	explain *repositoryDecision
+}
+
+// repositoryResolver resolves the names in the policy into their ids.
+type repositoryResolver interface {
+	// repositoryID returns the id of the repository, or 0 if it is not found.
+	repositoryID(ctx context.Context, owner, repo string) (uint64, error)
+
+	// ownerID returns the id of the user or the organization, or 0 if it is not found.
+	ownerID(ctx context.Context, owner string) (uint64, error)
+}
+
+// grant returns the maximum permissions that the repository req.From can receive.
+// The second return value reports whether the access is allowed.
+func (c *policyConfig) grant(ctx context.Context, req *policyRequest, resolver repositoryResolver) (permissionSet, bool, error) {
+	return grantRules(ctx, c.source, "repositories", c.Repositories, req, resolver)
+}
+
+// selfGrant returns the maximum permissions that the workflows of the repository can receive for itself.
+// The second return value reports whether the access is allowed.
+func (c *policyConfig) selfGrant(ctx context.Context, req *policyRequest) (permissionSet, bool, error) {
+	if c.Self == nil {
+		return nil, true, nil
+	}
+	return grantRules(ctx, c.source, "self", c.Self, req, nil)
+}
+
+// orgPolicyConfig is the content of .github/org-actions.yaml in the <owner>/.github repository.
+// It is the policy for all repositories of the owner.
+type orgPolicyConfig struct {
+	// Repositories is the default list of repositories that are allowed to access the repositories of the owner.
+	// If it is not nil, the policies of the repositories can only narrow it.
+	Repositories []*repositoryRule `yaml:"repositories"`
+
+	// Deny is the list of repositories that are never allowed.
+	// The repository in the rules is optional; the rules without it match any repository.
+	Deny []*repositoryRule `yaml:"deny"`
+
+	// Organization is the list of repositories that can receive the tokens for the whole installation,
+	// without repository restriction. The rules must have permissions.
+	Organization []*repositoryRule `yaml:"organization"`
+
+	// source is the location of the policy file, such as "owner/.github/.github/org-actions.yaml".
+	// It is used to explain the decisions.
+	source string
+}
+
+// parseOrgPolicy parses .github/org-actions.yaml.
+func parseOrgPolicy(data []byte) (*orgPolicyConfig, error) {
+	var config orgPolicyConfig
+	if err := yaml.UnmarshalWithOptions(data, &config, yaml.Strict()); err != nil {
+		// the unknown keys are rejected, because a misspelled condition would widen the rule.
+		return nil, &validationError{
+			message: err.Error(),
+			err:     err,
+		}
+	}
+	if err := config.validate(); err != nil {
+		return nil, &validationError{
+			message: err.Error(),
+			err:     err,
+		}
+	}
+	return &config, nil
+}
+
+func (c *orgPolicyConfig) validate() error {
+	if err := validateGrantRules("repositories", c.Repositories); err != nil {
+		return err
+	}
+	if err := validateGrantRules("organization", c.Organization); err != nil {
+		return err
+	}
+	for i, rule := range c.Organization {
+		if rule.Permissions == nil {
+			return fmt.Errorf("organization[%d]: permissions are required in organization rules", i)
+		}
+	}
+	for i, rule := range c.Deny {
+		if rule == nil {
+			return fmt.Errorf("deny[%d]: rule is required", i)
+		}
+		if rule.Permissions != nil {
+			return fmt.Errorf("deny[%d]: permissions are not allowed in deny rules", i)
+		}
+		if err := rule.compile(); err != nil {
+			return fmt.Errorf("deny[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// denied reports whether the request matches any of the deny rules.
+func (c *orgPolicyConfig) denied(ctx context.Context, req *policyRequest, resolver repositoryResolver) (bool, error) {
+	for i, rule := range c.Deny {
+		// if the condition fails, deny the request to be safe.
+		matched, reason, err := rule.match(ctx, req, resolver, true)
+		if err != nil {
+			return false, err
+		}
+		req.explain.record(c.source, fmt.Sprintf("deny[%d]", i), matched, reason, nil)
+		if matched {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// organizationGrant returns the maximum permissions that the repository req.From can receive
+// for the token without repository restriction.
+// The second return value reports whether the access is allowed.
+func (c *orgPolicyConfig) organizationGrant(ctx context.Context, req *policyRequest, resolver repositoryResolver) (permissionSet, bool, error) {
+	denied, err := c.denied(ctx, req, resolver)
+	if err != nil {
+		return nil, false, err
+	}
+	if denied {
+		return nil, false, nil
+	}
+	return grantRules(ctx, c.source, "organization", c.Organization, req, resolver)
+}
+
+// evaluatePolicies returns the maximum permissions that the repository req.From can receive
+// under the organization policy org and the repository policy repo.
+// Either of them may be nil, but not both.
+// The second return value reports whether the access is allowed.
+func evaluatePolicies(ctx context.Context, org *orgPolicyConfig, repo *policyConfig, req *policyRequest, resolver repositoryResolver) (permissionSet, bool, error) {
+	var ret permissionSet
+	allowed := false
+	if org != nil {
+		denied, err := org.denied(ctx, req, resolver)
+		if err != nil {
+			return nil, false, err
+		}
+		if denied {
+			return nil, false, nil
+		}
+
+		if org.Repositories != nil {
+			permissions, ok, err := grantRules(ctx, org.source, "repositories", org.Repositories, req, resolver)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				return nil, false, nil
+			}
+			ret = permissions
+			allowed = true
+		}
+	}
+
+	if repo != nil {
+		permissions, ok, err := repo.grant(ctx, req, resolver)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			return nil, false, nil
+		}
+		ret = ret.intersect(permissions)
+		allowed = true
+	}
+
+	return ret, allowed, nil
+}
+
+// grantRules returns the maximum permissions that the repository req.From can receive under the rules.
+// The second return value reports whether any of the rules matches.
+// source and section identify the rules in the explanation of the decision.
+func grantRules(ctx context.Context, source, section string, rules []*repositoryRule, req *policyRequest, resolver repositoryResolver) (permissionSet, bool, error) {
+	var ret permissionSet
+	allowed := false
+	for i, rule := range rules {
+		// if the condition fails, ignore the rule to be safe.
+		matched, reason, err := rule.match(ctx, req, resolver, false)
+		if err != nil {
+			return nil, false, err
+		}
+		req.explain.record(source, fmt.Sprintf("%s[%d]", section, i), matched, reason, rule.Permissions)
+		if !matched {
+			continue
+		}
+		if !allowed {
+			ret = rule.Permissions
+			allowed = true
+			continue
+		}
+		ret = ret.union(rule.Permissions)
+	}
+	return ret, allowed, nil
+}
+
+// match reports whether the rule matches the request.
+// If the evaluation of the condition fails, match returns onError.
+// The second return value describes why the rule doesn't match, or why the evaluation fails.
+func (r *repositoryRule) match(ctx context.Context, req *policyRequest, resolver repositoryResolver, onError bool) (bool, string, error) {
+	if reason := r.Conditions.mismatch(req.From.Claims); reason != "" {
+		return false, reason, nil
+	}
+	if r.condition != nil {
+		matched, err := r.condition.eval(ctx, req)
+		if err != nil {
+			slog.DebugContext(ctx, "failed to evaluate the condition", errAttr(err))
+			return onError, err.Error(), nil
+		}
+		if !matched {
+			return false, "the condition is false", nil
+		}
+	}
+	if r.Repository == "" {
+		return true, "", nil
+	}
+	matched, err := r.matchRepository(ctx, req.From, resolver)
+	if err != nil {
+		return false, "", err
+	}
+	if !matched {
+		return false, "the repository doesn't match", nil
+	}
+	return true, "", nil
+}
+
+// matchRepository reports whether the rule matches the repository from.
+// The names in the rule are resolved into the ids, and compared with the ids of from.
+// So another repository that reuses an old name can't take over the rule.
+func (r *repositoryRule) matchRepository(ctx context.Context, from *callerRepository, resolver repositoryResolver) (bool, error) {
+	owner, name, ok := strings.Cut(r.Repository, "/")
+	if !ok {
+		// it is a global node id.
+		return r.Repository == from.NodeID, nil
+	}
+
+	// GitHub treats the names as case-insensitive.
+	pattern := strings.ToLower(r.Repository)
+	fullName := strings.ToLower(from.Claims.Repository)
+	if matched, _ := path.Match(pattern, fullName); !matched {
+		return false, nil
+	}
+
+	if !hasGlobMeta(name) {
+		id, err := resolver.repositoryID(ctx, owner, name)
+		if err != nil {
+			return false, err
+		}
+		return id != 0 && id == from.ID, nil
+	}
+
+	id, err := resolver.ownerID(ctx, owner)
+	if err != nil {
+		return false, err
+	}
+	return id != 0 && id == from.OwnerID, nil
+}
+
+// validateRepository validates the repository in the rule.
+func validateRepository(repository string) error {
+	owner, name, ok := strings.Cut(repository, "/")
+	if !ok {
+		// it is a global node id.
+		return nil
+	}
+	if owner == "" || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid repository name: %q", repository)
+	}
+	if hasGlobMeta(owner) {
+		return fmt.Errorf("the owner must not be a pattern: %q", repository)
+	}
+	if _, err := path.Match(name, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", repository, err)
+	}
+	return nil
+}
+
+// validateJobWorkflowRef validates job_workflow_ref in the rule without repository.
+// The patterns must name the repository of the workflow, such as "my-org/ci/.github/workflows/release.yml@refs/heads/main",
+// so that the rule doesn't trust the workflows in any repository.
+func validateJobWorkflowRef(patterns patternList) error {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "!") {
+			return fmt.Errorf("job_workflow_ref must not be negated in the rule without repository: %q", pattern)
+		}
+		parts := strings.SplitN(pattern, "/", 3)
+		if len(parts) < 3 || parts[0] == "" || parts[1] == "" || hasGlobMeta(parts[0]) || hasGlobMeta(parts[1]) {
+			return fmt.Errorf("job_workflow_ref must start with the repository of the workflow in the rule without repository: %q", pattern)
+		}
+	}
+	return nil
+}
+
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, `*?\`)
+}
+
+// claimConditions are the conditions on the claims of the OIDC token.
+// All of the conditions must be satisfied.
+type claimConditions struct {
+	Ref                  patternList `yaml:"ref"`
+	RefType              patternList `yaml:"ref_type"`
+	RefProtected         patternList `yaml:"ref_protected"`
+	Environment          patternList `yaml:"environment"`
+	EventName            patternList `yaml:"event_name"`
+	Workflow             patternList `yaml:"workflow"`
+	WorkflowRef          patternList `yaml:"workflow_ref"`
+	WorkflowSHA          patternList `yaml:"workflow_sha"`
+	JobWorkflowRef       patternList `yaml:"job_workflow_ref"`
+	JobWorkflowSHA       patternList `yaml:"job_workflow_sha"`
+	Actor                patternList `yaml:"actor"`
+	RepositoryVisibility patternList `yaml:"repository_visibility"`
+	RunnerEnvironment    patternList `yaml:"runner_environment"`
+	Enterprise           patternList `yaml:"enterprise"`
+
+	// Subject is the patterns of the subject claim, that may be customized by the organization.
+	Subject subjectPatterns `yaml:"sub"`
+}
+
+// claimCondition is a pair of a condition and the claim value that it checks.
+type claimCondition struct {
+	name    string
+	pattern patternList
+	value   string
+}
+
+func (c *claimConditions) conditions(id *github.ActionsIDToken) []claimCondition {
+	return []claimCondition{
+		{"ref", c.Ref, id.Ref},
+		{"ref_type", c.RefType, id.RefType},
+		{"ref_protected", c.RefProtected, id.RefProtected},
+		{"environment", c.Environment, id.Environment},
+		{"event_name", c.EventName, id.EventName},
+		{"workflow", c.Workflow, id.Workflow},
+		{"workflow_ref", c.WorkflowRef, id.WorkflowRef},
+		{"workflow_sha", c.WorkflowSHA, id.WorkflowSHA},
+		{"job_workflow_ref", c.JobWorkflowRef, id.JobWorkflowRef},
+		{"job_workflow_sha", c.JobWorkflowSHA, id.JobWorkflowSHA},
+		{"actor", c.Actor, id.Actor},
+		{"repository_visibility", c.RepositoryVisibility, id.RepositoryVisibility},
+		{"runner_environment", c.RunnerEnvironment, id.RunnerEnvironment},
+		{"enterprise", c.Enterprise, id.Enterprise},
+	}
+}
+
+func (c *claimConditions) validate() error {
+	for _, f := range c.conditions(&github.ActionsIDToken{}) {
+		if err := f.pattern.validate(); err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// mismatch returns the description of the first condition that the claims of id don't satisfy.
+// It returns an empty string if all of the conditions are satisfied.
+func (c *claimConditions) mismatch(id *github.ActionsIDToken) string {
+	for _, f := range c.conditions(id) {
+		if !f.pattern.match(f.value) {
+			return fmt.Sprintf("%s %q doesn't match", f.name, f.value)
+		}
+	}
+	var sub string
+	if id.Claims != nil {
+		sub = id.Subject
+	}
+	if !c.Subject.match(sub) {
+		return fmt.Sprintf("sub %q doesn't match", sub)
+	}
+	return ""
+}
+
+// patternList is a list of glob patterns in the syntax of [compileGlob].
+// A pattern that starts with "!" excludes the values that match it.
+// In YAML, it is either a string or a list of strings.
+type patternList []string
+
+func (l *patternList) UnmarshalYAML(unmarshal func(any) error) error {
+	var pattern string
+	if err := unmarshal(&pattern); err == nil {
+		*l = patternList{pattern}
+		return nil
+	}
+
+	var patterns []string
+	if err := unmarshal(&patterns); err != nil {
+		return err
+	}
+	*l = patternList(patterns)
+	return nil
+}
+
+func (l patternList) validate() error {
+	for _, pattern := range l {
+		pattern = strings.TrimPrefix(pattern, "!")
+		if _, err := compileGlob(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// match reports whether s matches the patterns.
+// An empty list matches any string.
+func (l patternList) match(s string) bool {
+	matched, hasPositive := false, false
+	for _, pattern := range l {
+		if negated, ok := strings.CutPrefix(pattern, "!"); ok {
+			// validate rejects the invalid patterns, so they exclude everything here to fail closed.
+			re, err := compileGlob(negated)
+			if err != nil || re.MatchString(s) {
+				return false
+			}
+			continue
+		}
+		hasPositive = true
+		if re, err := compileGlob(pattern); err == nil && re.MatchString(s) {
+			matched = true
+		}
+	}
+	return matched || !hasPositive
+}
+
+// compileGlob compiles the glob pattern into the regular expression that matches the whole string.
+// Unlike [path.Match], "*" matches any sequence of characters including "/",
+// because the refs, the workflows and the subjects have "/".
+// "?" matches any single character, and "\" escapes the next character.
+// The other characters match themselves, so "dependabot[bot]" matches the login of the bot.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var buf strings.Builder
+	buf.WriteString("^")
+	escaped := false
+	for _, r := range pattern {
+		switch {
+		case escaped:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '*':
+			buf.WriteString(".*")
+		case r == '?':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
+
+// subjectMatcher matches the subject claim of the OIDC token.
+type subjectMatcher interface {
+	matchSubject(sub string) bool
+}
+
+// subjectMatchers are the syntaxes of the subject patterns, selected by the prefix of the pattern, such as "regexp:".
+// The patterns without a known prefix are glob patterns,
+// so that "repo:owner/*:ref:refs/heads/main" and "repo_id:123:context:*" work as they look.
+var subjectMatchers = map[string]func(pattern string) (subjectMatcher, error){
+	"glob":   newGlobSubjectMatcher,
+	"regexp": newRegexpSubjectMatcher,
+}
+
+// newGlobSubjectMatcher compiles the glob pattern in the syntax of [compileGlob].
+func newGlobSubjectMatcher(pattern string) (subjectMatcher, error) {
+	re, err := compileGlob(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return &regexpSubjectMatcher{re: re}, nil
+}
+
+type regexpSubjectMatcher struct {
+	re *regexp.Regexp
+}
+
+// newRegexpSubjectMatcher compiles the pattern. It must match the whole subject.
+func newRegexpSubjectMatcher(pattern string) (subjectMatcher, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	return &regexpSubjectMatcher{re: re}, nil
+}
+
+func (m *regexpSubjectMatcher) matchSubject(sub string) bool {
+	return m.re.MatchString(sub)
+}
+
+// subjectPatterns is a list of the subject patterns.
+// A pattern that starts with "!" excludes the subjects that match it.
+// In YAML, it is either a string or a list of strings.
+type subjectPatterns struct {
+	patterns []string
+	matchers []subjectMatcher
+}
+
+func (p *subjectPatterns) UnmarshalYAML(unmarshal func(any) error) error {
+	var patterns patternList
+	if err := patterns.UnmarshalYAML(unmarshal); err != nil {
+		return err
+	}
+	matchers := make([]subjectMatcher, 0, len(patterns))
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(pattern, "!")
+		newMatcher := newGlobSubjectMatcher
+		if kind, rest, ok := strings.Cut(pattern, ":"); ok {
+			if f, ok := subjectMatchers[kind]; ok {
+				newMatcher, pattern = f, rest
+			}
+		}
+		m, err := newMatcher(pattern)
+		if err != nil {
+			return err
+		}
+		matchers = append(matchers, m)
+	}
+	p.patterns = patterns
+	p.matchers = matchers
+	return nil
+}
+
+// match reports whether sub matches the patterns.
+// An empty list matches any subject.
+func (p subjectPatterns) match(sub string) bool {
+	matched, hasPositive := false, false
+	for i, m := range p.matchers {
+		if strings.HasPrefix(p.patterns[i], "!") {
+			if m.matchSubject(sub) {
+				return false
+			}
+			continue
+		}
+		hasPositive = true
+		if m.matchSubject(sub) {
+			matched = true
+		}
+	}
+	return matched || !hasPositive
+}
+
+// permissionSet is a set of permissions. The keys are permission names, such as "contents",
+// and the values are access levels, such as "read" and "write".
+// nil means no restriction.
+type permissionSet map[string]string
+
+// permissionLevels is the order of the access levels.
+var permissionLevels = map[string]int{
+	"read":  1,
+	"write": 2,
+	"admin": 3,
+}
+
+// permissionNames is the set of the permission names that GitHub accepts.
+var permissionNames = func() map[string]int {
+	t := reflect.TypeFor[permissions]()
+	names := make(map[string]int, t.NumField())
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		names[name] = i
+	}
+	return names
+}()
+
+func (s permissionSet) validate() error {
+	for _, name := range s.names() {
+		if _, ok := permissionNames[name]; !ok {
+			return fmt.Errorf("unknown permission: %q", name)
+		}
+		if _, ok := permissionLevels[s[name]]; !ok {
+			return fmt.Errorf("invalid access level for %s: %q", name, s[name])
+		}
+	}
+	return nil
+}
+
+// names returns the sorted permission names in the set.
+func (s permissionSet) names() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// union returns the permissions that are granted by either s or other.
+func (s permissionSet) union(other permissionSet) permissionSet {
+	if s == nil || other == nil {
+		return nil
+	}
+	ret := make(permissionSet, len(s)+len(other))
+	for name, level := range s {
+		ret[name] = level
+	}
+	for name, level := range other {
+		if permissionLevels[level] > permissionLevels[ret[name]] {
+			ret[name] = level
+		}
+	}
+	return ret
+}
+
+// intersect returns the permissions that are granted by both s and other.
+func (s permissionSet) intersect(other permissionSet) permissionSet {
+	if s == nil {
+		return other
+	}
+	if other == nil {
+		return s
+	}
+	ret := make(permissionSet, len(s))
+	for name, level := range s {
+		otherLevel, ok := other[name]
+		if !ok {
+			continue
+		}
+		if permissionLevels[otherLevel] < permissionLevels[level] {
+			level = otherLevel
+		}
+		ret[name] = level
+	}
+	return ret
+}
+
+// check checks that the requested permissions are within s.
+func (s permissionSet) check(requested permissionSet) error {
+	if s == nil {
+		return nil
+	}
+	for _, name := range requested.names() {
+		level := requested[name]
+		if name == "metadata" && level == "read" {
+			// GitHub always grants read access to the metadata.
+			continue
+		}
+		if permissionLevels[level] > permissionLevels[s[name]] {
+			if s[name] == "" {
+				return fmt.Errorf("%s is not allowed", name)
+			}
+			return fmt.Errorf("%s: %s is not allowed, up to %s", name, level, s[name])
+		}
+	}
+	return nil
+}
+
+// toPermissionSet converts the permissions of the request into permissionSet.
+func (p *permissions) toPermissionSet() permissionSet {
+	if p == nil {
+		return nil
+	}
+	v := reflect.ValueOf(p).Elem()
+	ret := permissionSet{}
+	for name, i := range permissionNames {
+		if level := v.Field(i).String(); level != "" {
+			ret[name] = level
+		}
+	}
+	return ret
+}
+
+// toPermissions converts the permission set into permissions of the request.
+func (s permissionSet) toPermissions() (*permissions, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var p permissions
+	v := reflect.ValueOf(&p).Elem()
+	for name, level := range s {
+		i, ok := permissionNames[name]
+		if !ok {
+			return nil, errors.New("unknown permission: " + name)
+		}
+		v.Field(i).SetString(level)
+	}
+	return &p, nil
+}
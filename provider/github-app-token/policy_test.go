@@ -0,0 +1,980 @@
+package githubapptoken
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+)
+
+func TestParsePolicy(t *testing.T) {
+	content := `
+repositories:
+  - R_kgDOF8HFZg
+  - repository: R_kgDOIeornQ
+    permissions:
+      contents: read
+      pull_requests: write
+`
+	config, err := parsePolicy([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &policyConfig{
+		Repositories: []*repositoryRule{
+			{
+				Repository: "R_kgDOF8HFZg",
+			},
+			{
+				Repository: "R_kgDOIeornQ",
+				Permissions: permissionSet{
+					"contents":      "read",
+					"pull_requests": "write",
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("unexpected config: want %#v, got %#v", want, config)
+	}
+}
+
+// resolverMock resolves the names from the fixed tables.
+type resolverMock struct {
+	repos  map[string]uint64
+	owners map[string]uint64
+}
+
+func (r *resolverMock) repositoryID(ctx context.Context, owner, repo string) (uint64, error) {
+	return r.repos[owner+"/"+repo], nil
+}
+
+func (r *resolverMock) ownerID(ctx context.Context, owner string) (uint64, error) {
+	return r.owners[owner], nil
+}
+
+func TestParsePolicy_Invalid(t *testing.T) {
+	cases := []string{
+		// the owner must not be a pattern
+		"repositories:\n  - shogo82148-*/actions-github-app-token\n",
+
+		// invalid pattern
+		"repositories:\n  - shogo82148/[\n",
+
+		// too many slashes
+		"repositories:\n  - shogo82148/actions/github-app-token\n",
+
+		// unknown permission
+		"repositories:\n  - repository: R_kgDOF8HFZg\n    permissions:\n      unknown: read\n",
+
+		// invalid access level
+		"repositories:\n  - repository: R_kgDOF8HFZg\n    permissions:\n      contents: delete\n",
+
+		// missing repository
+		"repositories:\n  - permissions:\n      contents: read\n",
+
+		// job_workflow_ref without the repository of the workflow
+		"repositories:\n  - job_workflow_ref: \"*/.github/workflows/release.yml@refs/heads/main\"\n",
+		"repositories:\n  - job_workflow_ref: my-org/*/.github/workflows/release.yml@refs/heads/main\n",
+
+		// negated job_workflow_ref without repository
+		"repositories:\n  - job_workflow_ref: \"!my-org/ci/.github/workflows/release.yml@refs/heads/main\"\n",
+
+		// misspelled condition, that would widen the rule
+		"repositories:\n  - repository: R_kgDOF8HFZg\n    evnt_name: \"!pull_request\"\n",
+		"self:\n  - ref: refs/heads/main\n    permision:\n      contents: write\n",
+		"repository:\n  - R_kgDOF8HFZg\n",
+	}
+	for i, c := range cases {
+		// the errors are in the policy, not in the API.
+		_, err := parsePolicy([]byte(c))
+		var validation *validationError
+		if !errors.As(err, &validation) {
+			t.Errorf("%d: want validation error, got %v", i, err)
+		}
+	}
+}
+
+func TestPolicyConfig_Grant(t *testing.T) {
+	config := &policyConfig{
+		Repositories: []*repositoryRule{
+			{
+				Repository: "R_unlimited",
+			},
+			{
+				Repository:  "R_limited",
+				Permissions: permissionSet{"contents": "read"},
+			},
+			{
+				Repository:  "R_limited",
+				Permissions: permissionSet{"contents": "write", "issues": "read"},
+			},
+		},
+	}
+
+	cases := []struct {
+		from        string
+		want        permissionSet
+		wantAllowed bool
+	}{
+		{
+			from:        "R_unlimited",
+			want:        nil,
+			wantAllowed: true,
+		},
+		{
+			from:        "R_limited",
+			want:        permissionSet{"contents": "write", "issues": "read"},
+			wantAllowed: true,
+		},
+		{
+			from:        "R_unknown",
+			want:        nil,
+			wantAllowed: false,
+		},
+	}
+	for _, c := range cases {
+		from := &callerRepository{
+			NodeID: c.from,
+			Claims: &github.ActionsIDToken{},
+		}
+		got, allowed, err := config.grant(context.Background(), &policyRequest{From: from}, &resolverMock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != c.wantAllowed {
+			t.Errorf("%s: unexpected allowed: want %t, got %t", c.from, c.wantAllowed, allowed)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: unexpected permissions: want %v, got %v", c.from, c.want, got)
+		}
+	}
+}
+
+func TestPermissionSet_Intersect(t *testing.T) {
+	cases := []struct {
+		a, b permissionSet
+		want permissionSet
+	}{
+		{
+			a:    nil,
+			b:    nil,
+			want: nil,
+		},
+		{
+			a:    permissionSet{"contents": "read"},
+			b:    nil,
+			want: permissionSet{"contents": "read"},
+		},
+		{
+			a:    permissionSet{"contents": "write", "issues": "write"},
+			b:    permissionSet{"contents": "read", "pull_requests": "write"},
+			want: permissionSet{"contents": "read"},
+		},
+	}
+	for i, c := range cases {
+		got := c.a.intersect(c.b)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%d: want %v, got %v", i, c.want, got)
+		}
+	}
+}
+
+func TestPermissionSet_Check(t *testing.T) {
+	ceiling := permissionSet{"contents": "write", "issues": "read"}
+
+	cases := []struct {
+		requested permissionSet
+		wantErr   bool
+	}{
+		{
+			requested: permissionSet{"contents": "read"},
+			wantErr:   false,
+		},
+		{
+			requested: permissionSet{"contents": "write", "issues": "read"},
+			wantErr:   false,
+		},
+		{
+			requested: permissionSet{"metadata": "read"},
+			wantErr:   false,
+		},
+		{
+			requested: permissionSet{"issues": "write"},
+			wantErr:   true,
+		},
+		{
+			requested: permissionSet{"administration": "read"},
+			wantErr:   true,
+		},
+	}
+	for i, c := range cases {
+		err := ceiling.check(c.requested)
+		if (err != nil) != c.wantErr {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+	}
+}
+
+func TestPermissions_Conversion(t *testing.T) {
+	p := &permissions{
+		Contents:     "read",
+		PullRequests: "write",
+	}
+	set := p.toPermissionSet()
+	want := permissionSet{"contents": "read", "pull_requests": "write"}
+	if !reflect.DeepEqual(set, want) {
+		t.Errorf("want %v, got %v", want, set)
+	}
+
+	got, err := set.toPermissions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("want %#v, got %#v", p, got)
+	}
+}
+
+func TestParsePolicy_Conditions(t *testing.T) {
+	content := `
+repositories:
+  - repository: R_kgDOF8HFZg
+    ref: refs/heads/main
+    event_name:
+      - "!pull_request"
+      - "!pull_request_target"
+`
+	config, err := parsePolicy([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &policyConfig{
+		Repositories: []*repositoryRule{
+			{
+				Repository: "R_kgDOF8HFZg",
+				Conditions: claimConditions{
+					Ref:       patternList{"refs/heads/main"},
+					EventName: patternList{"!pull_request", "!pull_request_target"},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("unexpected config: want %#v, got %#v", want, config)
+	}
+
+	if _, err := parsePolicy([]byte("repositories:\n  - repository: R_kgDOF8HFZg\n    ref: \"refs/heads/\\\\\"\n")); err == nil {
+		t.Error("want error for an invalid pattern, but not")
+	}
+}
+
+func TestPatternList_Match(t *testing.T) {
+	cases := []struct {
+		patterns patternList
+		input    string
+		want     bool
+	}{
+		{nil, "refs/heads/main", true},
+		{patternList{"refs/heads/main"}, "refs/heads/main", true},
+		{patternList{"refs/heads/main"}, "refs/heads/feature", false},
+		{patternList{"refs/tags/v*"}, "refs/tags/v1.0.0", true},
+		{patternList{"refs/heads/*"}, "refs/heads/feature/foo", true},
+		{patternList{"refs/heads/v?"}, "refs/heads/v1", true},
+		{patternList{"refs/heads/v?"}, "refs/heads/v10", false},
+		{patternList{"!refs/heads/feature/*"}, "refs/heads/feature/a/b", false},
+		{patternList{"!refs/heads/feature/*"}, "refs/heads/main", true},
+		{patternList{"dependabot[bot]"}, "dependabot[bot]", true},
+		{patternList{"dependabot[bot]"}, "dependabotb", false},
+		{patternList{"!dependabot[bot]"}, "dependabot[bot]", false},
+		{patternList{"!dependabot[bot]"}, "shogo82148", true},
+		{patternList{`refs/tags/v\*`}, "refs/tags/v*", true},
+		{patternList{`refs/tags/v\*`}, "refs/tags/v1", false},
+		{patternList{`!refs/tags/v\`}, "refs/tags/v1", false},
+		{patternList{"!pull_request"}, "push", true},
+		{patternList{"!pull_request"}, "pull_request", false},
+		{patternList{"refs/heads/*", "!refs/heads/dev"}, "refs/heads/main", true},
+		{patternList{"refs/heads/*", "!refs/heads/dev"}, "refs/heads/dev", false},
+	}
+	for _, c := range cases {
+		got := c.patterns.match(c.input)
+		if got != c.want {
+			t.Errorf("%v.match(%q): want %t, got %t", c.patterns, c.input, c.want, got)
+		}
+	}
+}
+
+func TestSubjectPatterns_Match(t *testing.T) {
+	cases := []struct {
+		patterns string
+		input    string
+		want     bool
+	}{
+		{`"repo:shogo82148/*:ref:refs/heads/main"`, "repo:shogo82148/actions-github-app-token:ref:refs/heads/main", true},
+		{`"repo:shogo82148/*:ref:refs/heads/main"`, "repo:shogo82148/actions-github-app-token:pull_request", false},
+		{`"repo:shogo82148/*:ref:refs/heads/*"`, "repo:shogo82148/actions-github-app-token:ref:refs/heads/feature/foo", true},
+		{`"repo:shogo82148/actions-github-app-token:ref:refs/heads/v?"`, "repo:shogo82148/actions-github-app-token:ref:refs/heads/v1", true},
+		{`"repo:shogo82148/actions-github-app-token:ref:refs/heads/v?"`, "repo:shogo82148/actions-github-app-token:ref:refs/heads/v10", false},
+		{`"repo:shogo82148/actions.github-app-token:*"`, "repo:shogo82148/actions-github-app-token:pull_request", false},
+		{`"repo_id:398574950:context:prod*"`, "repo_id:398574950:context:production", true},
+		{`"repo_id:398574950:context:prod*"`, "repo_id:1296269:context:production", false},
+		{`"glob:repo:*"`, "repo:shogo82148/actions-github-app-token:ref:refs/heads/main", true},
+		{`"regexp:repo:shogo82148/.+:environment:(staging|production)"`, "repo:shogo82148/actions-github-app-token:environment:production", true},
+		{`"regexp:repo:shogo82148/.+:environment:(staging|production)"`, "repo:shogo82148/actions-github-app-token:environment:production-eu", false},
+		{`["repo:*", "!regexp:.*:pull_request"]`, "repo:shogo82148/actions-github-app-token:ref:refs/heads/main", true},
+		{`["repo:*", "!regexp:.*:pull_request"]`, "repo:shogo82148/actions-github-app-token:pull_request", false},
+	}
+	for _, c := range cases {
+		config, err := parsePolicy([]byte("repositories:\n  - repository: R_kgDOF8HFZg\n    sub: " + c.patterns + "\n"))
+		if err != nil {
+			t.Fatalf("%s: %v", c.patterns, err)
+		}
+		got := config.Repositories[0].Conditions.Subject.match(c.input)
+		if got != c.want {
+			t.Errorf("%s.match(%q): want %t, got %t", c.patterns, c.input, c.want, got)
+		}
+	}
+
+	for _, patterns := range []string{`"regexp:repo:("`, `["repo:*", "regexp:[z-a]"]`} {
+		if _, err := parsePolicy([]byte("repositories:\n  - repository: R_kgDOF8HFZg\n    sub: " + patterns + "\n")); err == nil {
+			t.Errorf("%s: want error for an invalid pattern, but not", patterns)
+		}
+	}
+}
+
+func TestPolicyConfig_GrantWithConditions(t *testing.T) {
+	config := &policyConfig{
+		Repositories: []*repositoryRule{
+			{
+				Repository:  "R_kgDOF8HFZg",
+				Permissions: permissionSet{"contents": "read"},
+				Conditions: claimConditions{
+					EventName: patternList{"!pull_request"},
+				},
+			},
+			{
+				Repository:  "R_kgDOF8HFZg",
+				Permissions: permissionSet{"contents": "write"},
+				Conditions: claimConditions{
+					Ref:         patternList{"refs/heads/main"},
+					Environment: patternList{"production"},
+					EventName:   patternList{"!pull_request"},
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name        string
+		id          *github.ActionsIDToken
+		want        permissionSet
+		wantAllowed bool
+	}{
+		{
+			name: "production",
+			id: &github.ActionsIDToken{
+				Ref:         "refs/heads/main",
+				Environment: "production",
+				EventName:   "push",
+			},
+			want:        permissionSet{"contents": "write"},
+			wantAllowed: true,
+		},
+		{
+			name: "feature branch",
+			id: &github.ActionsIDToken{
+				Ref:       "refs/heads/feature",
+				EventName: "push",
+			},
+			want:        permissionSet{"contents": "read"},
+			wantAllowed: true,
+		},
+		{
+			name: "pull request",
+			id: &github.ActionsIDToken{
+				Ref:       "refs/pull/1/merge",
+				EventName: "pull_request",
+			},
+			wantAllowed: false,
+		},
+	}
+	for _, c := range cases {
+		from := &callerRepository{
+			NodeID: "R_kgDOF8HFZg",
+			Claims: c.id,
+		}
+		got, allowed, err := config.grant(context.Background(), &policyRequest{From: from}, &resolverMock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != c.wantAllowed {
+			t.Errorf("%s: unexpected allowed: want %t, got %t", c.name, c.wantAllowed, allowed)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: unexpected permissions: want %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestPolicyConfig_GrantWithRunnerEnvironment(t *testing.T) {
+	// the self-hosted runners can't write.
+	config, err := parsePolicy([]byte("repositories:\n" +
+		"  - repository: R_kgDOF8HFZg\n" +
+		"    runner_environment: github-hosted\n" +
+		"    ref_protected: \"true\"\n" +
+		"    permissions:\n" +
+		"      contents: write\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		id          *github.ActionsIDToken
+		wantAllowed bool
+	}{
+		{
+			name: "github-hosted",
+			id: &github.ActionsIDToken{
+				RunnerEnvironment: "github-hosted",
+				RefProtected:      "true",
+			},
+			wantAllowed: true,
+		},
+		{
+			name: "self-hosted",
+			id: &github.ActionsIDToken{
+				RunnerEnvironment: "self-hosted",
+				RefProtected:      "true",
+			},
+			wantAllowed: false,
+		},
+		{
+			name: "unprotected ref",
+			id: &github.ActionsIDToken{
+				RunnerEnvironment: "github-hosted",
+				RefProtected:      "false",
+			},
+			wantAllowed: false,
+		},
+	}
+	for _, c := range cases {
+		from := &callerRepository{
+			NodeID: "R_kgDOF8HFZg",
+			Claims: c.id,
+		}
+		_, allowed, err := config.grant(context.Background(), &policyRequest{From: from}, &resolverMock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != c.wantAllowed {
+			t.Errorf("%s: unexpected allowed: want %t, got %t", c.name, c.wantAllowed, allowed)
+		}
+	}
+}
+
+func TestPolicyConfig_GrantWithJobWorkflow(t *testing.T) {
+	config, err := parsePolicy([]byte("repositories:\n" +
+		"  - job_workflow_ref: my-org/ci/.github/workflows/release.yml@refs/heads/main\n" +
+		"    job_workflow_sha: 3c1e0c6f8c7f4c1a9d5c1b5f0a8e6c4d2b1a0f9e\n" +
+		"    permissions:\n" +
+		"      contents: write\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		id          *github.ActionsIDToken
+		wantAllowed bool
+	}{
+		{
+			name: "pinned workflow",
+			id: &github.ActionsIDToken{
+				Repository:     "my-org/service-a",
+				JobWorkflowRef: "my-org/ci/.github/workflows/release.yml@refs/heads/main",
+				JobWorkflowSHA: "3c1e0c6f8c7f4c1a9d5c1b5f0a8e6c4d2b1a0f9e",
+			},
+			wantAllowed: true,
+		},
+		{
+			name: "another caller",
+			id: &github.ActionsIDToken{
+				Repository:     "other-org/service-b",
+				JobWorkflowRef: "my-org/ci/.github/workflows/release.yml@refs/heads/main",
+				JobWorkflowSHA: "3c1e0c6f8c7f4c1a9d5c1b5f0a8e6c4d2b1a0f9e",
+			},
+			wantAllowed: true,
+		},
+		{
+			name: "another commit",
+			id: &github.ActionsIDToken{
+				Repository:     "my-org/service-a",
+				JobWorkflowRef: "my-org/ci/.github/workflows/release.yml@refs/heads/main",
+				JobWorkflowSHA: "0000000000000000000000000000000000000000",
+			},
+			wantAllowed: false,
+		},
+		{
+			name: "another workflow",
+			id: &github.ActionsIDToken{
+				Repository:     "my-org/service-a",
+				JobWorkflowRef: "my-org/service-a/.github/workflows/release.yml@refs/heads/main",
+				JobWorkflowSHA: "3c1e0c6f8c7f4c1a9d5c1b5f0a8e6c4d2b1a0f9e",
+			},
+			wantAllowed: false,
+		},
+	}
+	for _, c := range cases {
+		from := &callerRepository{
+			NodeID: "R_kgDOF8HFZg",
+			Claims: c.id,
+		}
+		got, allowed, err := config.grant(context.Background(), &policyRequest{From: from}, &resolverMock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != c.wantAllowed {
+			t.Errorf("%s: unexpected allowed: want %t, got %t", c.name, c.wantAllowed, allowed)
+		}
+		if allowed && !reflect.DeepEqual(got, permissionSet{"contents": "write"}) {
+			t.Errorf("%s: unexpected permissions: %v", c.name, got)
+		}
+	}
+}
+
+func TestPolicyConfig_GrantWithNames(t *testing.T) {
+	config := &policyConfig{
+		Repositories: []*repositoryRule{
+			{
+				Repository:  "shogo82148/actions-github-app-token",
+				Permissions: permissionSet{"contents": "write"},
+			},
+			{
+				Repository:  "shogo82148/service-*",
+				Permissions: permissionSet{"contents": "read"},
+			},
+		},
+	}
+	resolver := &resolverMock{
+		repos: map[string]uint64{
+			"shogo82148/actions-github-app-token": 398574950,
+		},
+		owners: map[string]uint64{
+			"shogo82148": 1157344,
+		},
+	}
+
+	cases := []struct {
+		name        string
+		from        *callerRepository
+		want        permissionSet
+		wantAllowed bool
+	}{
+		{
+			name: "full name",
+			from: &callerRepository{
+				ID:      398574950,
+				OwnerID: 1157344,
+				Claims: &github.ActionsIDToken{
+					Repository: "Shogo82148/Actions-GitHub-App-Token",
+				},
+			},
+			want:        permissionSet{"contents": "write"},
+			wantAllowed: true,
+		},
+		{
+			name: "full name with another id",
+			from: &callerRepository{
+				ID:      123456789,
+				OwnerID: 1157344,
+				Claims: &github.ActionsIDToken{
+					Repository: "shogo82148/actions-github-app-token",
+				},
+			},
+			wantAllowed: false,
+		},
+		{
+			name: "pattern",
+			from: &callerRepository{
+				ID:      123456789,
+				OwnerID: 1157344,
+				Claims: &github.ActionsIDToken{
+					Repository: "shogo82148/service-foo",
+				},
+			},
+			want:        permissionSet{"contents": "read"},
+			wantAllowed: true,
+		},
+		{
+			name: "pattern with another owner id",
+			from: &callerRepository{
+				ID:      123456789,
+				OwnerID: 987654321,
+				Claims: &github.ActionsIDToken{
+					Repository: "shogo82148/service-foo",
+				},
+			},
+			wantAllowed: false,
+		},
+		{
+			name: "unmatched pattern",
+			from: &callerRepository{
+				ID:      123456789,
+				OwnerID: 1157344,
+				Claims: &github.ActionsIDToken{
+					Repository: "shogo82148/library-foo",
+				},
+			},
+			wantAllowed: false,
+		},
+	}
+	for _, c := range cases {
+		got, allowed, err := config.grant(context.Background(), &policyRequest{From: c.from}, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != c.wantAllowed {
+			t.Errorf("%s: unexpected allowed: want %t, got %t", c.name, c.wantAllowed, allowed)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: unexpected permissions: want %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestParseOrgPolicy(t *testing.T) {
+	content := `
+repositories:
+  - repository: shogo82148/*
+    permissions:
+      contents: write
+deny:
+  - event_name: pull_request_target
+  - repository: shogo82148/untrusted
+`
+	config, err := parseOrgPolicy([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &orgPolicyConfig{
+		Repositories: []*repositoryRule{
+			{
+				Repository:  "shogo82148/*",
+				Permissions: permissionSet{"contents": "write"},
+			},
+		},
+		Deny: []*repositoryRule{
+			{
+				Conditions: claimConditions{
+					EventName: patternList{"pull_request_target"},
+				},
+			},
+			{
+				Repository: "shogo82148/untrusted",
+			},
+		},
+	}
+	if !reflect.DeepEqual(config, want) {
+		t.Errorf("unexpected config: want %#v, got %#v", want, config)
+	}
+
+	_, err = parseOrgPolicy([]byte("deny:\n  - repository: shogo82148/foo\n    permissions:\n      contents: read\n"))
+	var validation *validationError
+	if !errors.As(err, &validation) {
+		t.Errorf("want validation error for permissions in deny rules, got %v", err)
+	}
+	_, err = parseOrgPolicy([]byte("deny:\n  - evnt_name: pull_request_target\n"))
+	if !errors.As(err, &validation) {
+		t.Errorf("want validation error for the unknown key, got %v", err)
+	}
+}
+
+func TestOrgPolicyConfig_OrganizationGrant(t *testing.T) {
+	config, err := parseOrgPolicy([]byte(`
+organization:
+  - repository: shogo82148/admin
+    ref: refs/heads/main
+    permissions:
+      members: read
+      organization_secrets: write
+deny:
+  - event_name: pull_request_target
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &resolverMock{
+		repos: map[string]uint64{"shogo82148/admin": 123},
+	}
+
+	cases := []struct {
+		name        string
+		id          *github.ActionsIDToken
+		want        permissionSet
+		wantAllowed bool
+	}{
+		{
+			name: "main branch",
+			id: &github.ActionsIDToken{
+				Repository: "shogo82148/admin",
+				Ref:        "refs/heads/main",
+				EventName:  "push",
+			},
+			want:        permissionSet{"members": "read", "organization_secrets": "write"},
+			wantAllowed: true,
+		},
+		{
+			name: "feature branch",
+			id: &github.ActionsIDToken{
+				Repository: "shogo82148/admin",
+				Ref:        "refs/heads/feature",
+				EventName:  "push",
+			},
+			wantAllowed: false,
+		},
+		{
+			name: "denied event",
+			id: &github.ActionsIDToken{
+				Repository: "shogo82148/admin",
+				Ref:        "refs/heads/main",
+				EventName:  "pull_request_target",
+			},
+			wantAllowed: false,
+		},
+	}
+	for _, c := range cases {
+		from := &callerRepository{ID: 123, Claims: c.id}
+		got, allowed, err := config.organizationGrant(context.Background(), &policyRequest{From: from}, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != c.wantAllowed {
+			t.Errorf("%s: unexpected allowed: want %t, got %t", c.name, c.wantAllowed, allowed)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: unexpected permissions: want %v, got %v", c.name, c.want, got)
+		}
+	}
+
+	if _, err := parseOrgPolicy([]byte("organization:\n  - repository: shogo82148/admin\n")); err == nil {
+		t.Error("want error for organization rules without permissions, but not")
+	}
+}
+
+func TestEvaluatePolicies(t *testing.T) {
+	org := &orgPolicyConfig{
+		Repositories: []*repositoryRule{
+			{
+				Repository:  "shogo82148/*",
+				Permissions: permissionSet{"contents": "read", "issues": "write"},
+			},
+		},
+		Deny: []*repositoryRule{
+			{
+				Conditions: claimConditions{
+					EventName: patternList{"pull_request_target"},
+				},
+			},
+		},
+	}
+	denyOnly := &orgPolicyConfig{
+		Deny: []*repositoryRule{
+			{
+				Repository: "shogo82148/untrusted",
+			},
+		},
+	}
+	repo := &policyConfig{
+		Repositories: []*repositoryRule{
+			{
+				Repository:  "shogo82148/actions-github-app-token",
+				Permissions: permissionSet{"contents": "write"},
+			},
+		},
+	}
+	resolver := &resolverMock{
+		repos: map[string]uint64{
+			"shogo82148/actions-github-app-token": 398574950,
+			"shogo82148/untrusted":                123456789,
+		},
+		owners: map[string]uint64{
+			"shogo82148": 1157344,
+		},
+	}
+	trusted := &callerRepository{
+		ID:      398574950,
+		OwnerID: 1157344,
+		Claims: &github.ActionsIDToken{
+			Repository: "shogo82148/actions-github-app-token",
+			EventName:  "push",
+		},
+	}
+	untrusted := &callerRepository{
+		ID:      123456789,
+		OwnerID: 1157344,
+		Claims: &github.ActionsIDToken{
+			Repository: "shogo82148/untrusted",
+			EventName:  "push",
+		},
+	}
+	pullRequestTarget := &callerRepository{
+		ID:      398574950,
+		OwnerID: 1157344,
+		Claims: &github.ActionsIDToken{
+			Repository: "shogo82148/actions-github-app-token",
+			EventName:  "pull_request_target",
+		},
+	}
+
+	cases := []struct {
+		name        string
+		org         *orgPolicyConfig
+		repo        *policyConfig
+		from        *callerRepository
+		want        permissionSet
+		wantAllowed bool
+	}{
+		{
+			name:        "organization default",
+			org:         org,
+			from:        untrusted,
+			want:        permissionSet{"contents": "read", "issues": "write"},
+			wantAllowed: true,
+		},
+		{
+			name:        "repository narrows the default",
+			org:         org,
+			repo:        repo,
+			from:        trusted,
+			want:        permissionSet{"contents": "read"},
+			wantAllowed: true,
+		},
+		{
+			name:        "repository can't widen the default",
+			org:         org,
+			repo:        repo,
+			from:        untrusted,
+			wantAllowed: false,
+		},
+		{
+			name:        "hard deny",
+			org:         org,
+			repo:        repo,
+			from:        pullRequestTarget,
+			wantAllowed: false,
+		},
+		{
+			name:        "deny only organization policy",
+			org:         denyOnly,
+			repo:        repo,
+			from:        trusted,
+			want:        permissionSet{"contents": "write"},
+			wantAllowed: true,
+		},
+		{
+			name:        "deny only organization policy without repository policy",
+			org:         denyOnly,
+			from:        trusted,
+			wantAllowed: false,
+		},
+		{
+			name:        "repository policy only",
+			repo:        repo,
+			from:        trusted,
+			want:        permissionSet{"contents": "write"},
+			wantAllowed: true,
+		},
+	}
+	for _, c := range cases {
+		got, allowed, err := evaluatePolicies(context.Background(), c.org, c.repo, &policyRequest{From: c.from}, resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != c.wantAllowed {
+			t.Errorf("%s: unexpected allowed: want %t, got %t", c.name, c.wantAllowed, allowed)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: unexpected permissions: want %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestPolicyConfig_SelfGrant(t *testing.T) {
+	content := `
+self:
+  - event_name: "!pull_request"
+    permissions:
+      contents: write
+  - ref: refs/heads/main
+    event_name: "!pull_request"
+    permissions:
+      administration: write
+`
+	config, err := parsePolicy([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name        string
+		id          *github.ActionsIDToken
+		want        permissionSet
+		wantAllowed bool
+	}{
+		{
+			name: "main branch",
+			id: &github.ActionsIDToken{
+				Ref:       "refs/heads/main",
+				EventName: "push",
+			},
+			want:        permissionSet{"contents": "write", "administration": "write"},
+			wantAllowed: true,
+		},
+		{
+			name: "feature branch",
+			id: &github.ActionsIDToken{
+				Ref:       "refs/heads/feature",
+				EventName: "push",
+			},
+			want:        permissionSet{"contents": "write"},
+			wantAllowed: true,
+		},
+		{
+			name: "pull request",
+			id: &github.ActionsIDToken{
+				Ref:       "refs/heads/main",
+				EventName: "pull_request",
+			},
+			wantAllowed: false,
+		},
+	}
+	for _, c := range cases {
+		got, allowed, err := config.selfGrant(context.Background(), &policyRequest{From: &callerRepository{Claims: c.id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != c.wantAllowed {
+			t.Errorf("%s: unexpected allowed: want %t, got %t", c.name, c.wantAllowed, allowed)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: unexpected permissions: want %v, got %v", c.name, c.want, got)
+		}
+	}
+
+	// no self rules
+	config, err = parsePolicy([]byte("repositories: []\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, allowed, err := config.selfGrant(context.Background(), &policyRequest{From: &callerRepository{Claims: &github.ActionsIDToken{}}}); err != nil || !allowed || got != nil {
+		t.Errorf("want no restriction, got %v, %t", got, allowed)
+	}
+
+	// the repository is not allowed in self rules
+	if _, err := parsePolicy([]byte("self:\n  - repository: R_kgDOF8HFZg\n")); err == nil {
+		t.Error("want error, but not")
+	}
+}
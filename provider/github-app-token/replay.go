@@ -0,0 +1,208 @@
+package githubapptoken
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+)
+
+// replayStore counts the uses of the OIDC tokens, to reject the tokens that are replayed.
+type replayStore interface {
+	// use records a use of the OIDC token, and returns how many times the token is used, including this one.
+	// The record can be removed after expiresAt, because the token is no longer valid.
+	use(ctx context.Context, key string, expiresAt time.Time) (int64, error)
+
+	// refund cancels a use recorded by use, because no token is issued for it.
+	refund(ctx context.Context, key string) error
+}
+
+// replayKey returns the key of the OIDC token in replayStore.
+// It is the jti claim, or the run attempt and the issued time if the token has no jti.
+func replayKey(id *github.ActionsIDToken) string {
+	if id.JWTID != "" {
+		return hashToken(id.Issuer + "\n" + id.JWTID)
+	}
+	return hashToken(fmt.Sprintf("%s\n%s\n%s\n%s\n%d", id.Issuer, id.RepositoryID, id.RunID, id.RunAttempt, id.IssuedAt.Unix()))
+}
+
+// checkReplay rejects the OIDC token if it is used more than h.maxUses times.
+func (h *Handler) checkReplay(ctx context.Context, id *github.ActionsIDToken) error {
+	if h.replay == nil || h.maxUses <= 0 {
+		return nil
+	}
+	expiresAt := id.ExpirationTime
+	if expiresAt.IsZero() {
+		// GitHub always sets exp, but just in case.
+		expiresAt = time.Now().Add(time.Hour)
+	}
+	uses, err := h.replay.use(ctx, replayKey(id), expiresAt)
+	if err != nil {
+		return fmt.Errorf("failed to record the use of the OIDC token: %w", err)
+	}
+	if uses > h.maxUses {
+		slog.WarnContext(ctx, "the OIDC token is replayed", claimsAttr(id), slog.Int64("uses", uses))
+		return &forbiddenError{
+			err: fmt.Errorf("the OIDC token is already used %d times; request a new OIDC token for each request", h.maxUses),
+		}
+	}
+	return nil
+}
+
+// refundReplay cancels the use of the OIDC token recorded by checkReplay,
+// so that the caller can retry with the same OIDC token after a failure such as a transient error of GitHub.
+func (h *Handler) refundReplay(ctx context.Context, id *github.ActionsIDToken) {
+	if h.replay == nil || h.maxUses <= 0 {
+		return
+	}
+	if err := h.replay.refund(ctx, replayKey(id)); err != nil {
+		slog.WarnContext(ctx, "failed to refund the use of the OIDC token", errAttr(err))
+	}
+}
+
+// newReplayStore creates the replayStore from the environment variables:
+//
+//   - GITHUB_OIDC_MAX_USES: how many times an OIDC token can issue the tokens. The default is 1, and 0 disables the replay protection.
+//   - GITHUB_OIDC_REPLAY_TABLE: the name of the DynamoDB table that records the uses. The default is the memory of each instance.
+func newReplayStore(cfg aws.Config) (replayStore, int64, error) {
+	maxUses := int64(1)
+	if v := os.Getenv("GITHUB_OIDC_MAX_USES"); v != "" {
+		var err error
+		maxUses, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxUses < 0 {
+			return nil, 0, fmt.Errorf("invalid GITHUB_OIDC_MAX_USES: %q", v)
+		}
+	}
+	if maxUses == 0 {
+		return nil, 0, nil
+	}
+	if table := os.Getenv("GITHUB_OIDC_REPLAY_TABLE"); table != "" {
+		return &dynamoDBReplayStore{
+			svc:   dynamodb.NewFromConfig(cfg),
+			table: table,
+		}, maxUses, nil
+	}
+	return newMemoryReplayStore(), maxUses, nil
+}
+
+// memoryReplayStore is a replayStore in the memory.
+// The records are not shared between the instances of the API,
+// so a token may be used up to maxUses times on each instance.
+type memoryReplayStore struct {
+	mu      sync.Mutex
+	records map[string]*replayRecord
+	now     func() time.Time
+}
+
+type replayRecord struct {
+	uses      int64
+	expiresAt time.Time
+}
+
+func newMemoryReplayStore() *memoryReplayStore {
+	return &memoryReplayStore{
+		records: make(map[string]*replayRecord),
+		now:     time.Now,
+	}
+}
+
+func (s *memoryReplayStore) use(ctx context.Context, key string, expiresAt time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the expired tokens can't be used any more.
+	now := s.now()
+	for k, v := range s.records {
+		if v.expiresAt.Before(now) {
+			delete(s.records, k)
+		}
+	}
+
+	r, ok := s.records[key]
+	if !ok {
+		r = &replayRecord{expiresAt: expiresAt}
+		s.records[key] = r
+	}
+	r.uses++
+	return r.uses, nil
+}
+
+func (s *memoryReplayStore) refund(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.records[key]; ok && r.uses > 0 {
+		r.uses--
+	}
+	return nil
+}
+
+// dynamoDBService is a subset of Amazon DynamoDB client interface.
+type dynamoDBService interface {
+	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+}
+
+// dynamoDBReplayStore is a replayStore in a DynamoDB table, shared between the instances of the API.
+// The partition key of the table is "key" of the type String,
+// and the time to live of the table should be enabled on "expires_at".
+type dynamoDBReplayStore struct {
+	svc   dynamoDBService
+	table string
+}
+
+func (s *dynamoDBReplayStore) use(ctx context.Context, key string, expiresAt time.Time) (int64, error) {
+	out, err := s.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: key},
+		},
+		UpdateExpression: aws.String("ADD #uses :one SET #expires_at = if_not_exists(#expires_at, :expires_at)"),
+		ExpressionAttributeNames: map[string]string{
+			"#uses":       "uses",
+			"#expires_at": "expires_at",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one":        &types.AttributeValueMemberN{Value: "1"},
+			":expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, err
+	}
+	v, ok := out.Attributes["uses"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, errors.New("the uses attribute is not found")
+	}
+	return strconv.ParseInt(v.Value, 10, 64)
+}
+
+func (s *dynamoDBReplayStore) refund(ctx context.Context, key string) error {
+	_, err := s.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: key},
+		},
+		UpdateExpression:    aws.String("ADD #uses :minus_one"),
+		ConditionExpression: aws.String("#uses > :zero"),
+		ExpressionAttributeNames: map[string]string{
+			"#uses": "uses",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":minus_one": &types.AttributeValueMemberN{Value: "-1"},
+			":zero":      &types.AttributeValueMemberN{Value: "0"},
+		},
+	})
+	return err
+}
@@ -0,0 +1,322 @@
+package githubapptoken
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+	"github.com/shogo82148/goat/jwt"
+)
+
+func TestReplayKey(t *testing.T) {
+	issuedAt := time.Unix(1632493567, 0)
+	id := &github.ActionsIDToken{
+		Claims: &jwt.Claims{
+			Issuer:   "https://token.actions.githubusercontent.com",
+			JWTID:    "example-id",
+			IssuedAt: issuedAt,
+		},
+		RepositoryID: "74",
+		RunID:        "example-run-id",
+		RunAttempt:   "1",
+	}
+	key := replayKey(id)
+
+	// another issuer may use the same jti.
+	other := *id
+	other.Claims = &jwt.Claims{
+		Issuer:   "https://token.actions.githubusercontent.com/octocorp",
+		JWTID:    "example-id",
+		IssuedAt: issuedAt,
+	}
+	if replayKey(&other) == key {
+		t.Error("the keys of the different issuers are same")
+	}
+
+	// without jti, the run attempt and the issued time identify the token.
+	noJTI := *id
+	noJTI.Claims = &jwt.Claims{
+		Issuer:   "https://token.actions.githubusercontent.com",
+		IssuedAt: issuedAt,
+	}
+	retried := noJTI
+	retried.RunAttempt = "2"
+	if replayKey(&noJTI) == replayKey(&retried) {
+		t.Error("the keys of the different attempts are same")
+	}
+}
+
+func TestMemoryReplayStore(t *testing.T) {
+	now := time.Now()
+	s := newMemoryReplayStore()
+	s.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for want := int64(1); want <= 3; want++ {
+		got, err := s.use(ctx, "token-1", now.Add(5*time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("want %d uses, got %d", want, got)
+		}
+	}
+
+	// the refunded use can be used again.
+	if err := s.refund(ctx, "token-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.use(ctx, "token-1", now.Add(5*time.Minute)); err != nil || got != 3 {
+		t.Errorf("want 3 uses, got %d, %v", got, err)
+	}
+
+	// the expired records are removed.
+	now = now.Add(10 * time.Minute)
+	if _, err := s.use(ctx, "token-2", now.Add(5*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.records["token-1"]; ok {
+		t.Error("the expired record is not removed")
+	}
+}
+
+// newDynamoDBStandIn starts a stand-in of DynamoDB that has only the table,
+// and supports only the requests of dynamoDBReplayStore and dynamoDBTokenStore.
+func newDynamoDBStandIn(t *testing.T, table string) *dynamodb.Client {
+	t.Helper()
+	type attributeValue map[string]string
+	type item map[string]attributeValue
+	var mu sync.Mutex
+	items := map[string]item{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+		writeError := func(typ, message string) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"__type":  "com.amazonaws.dynamodb.v20120810#" + typ,
+				"message": message,
+			})
+		}
+		var req struct {
+			TableName                 string                    `json:"TableName"`
+			Key                       item                      `json:"Key"`
+			Item                      item                      `json:"Item"`
+			UpdateExpression          string                    `json:"UpdateExpression"`
+			ExpressionAttributeValues map[string]attributeValue `json:"ExpressionAttributeValues"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		if req.TableName != table {
+			writeError("ResourceNotFoundException", "Requested resource not found")
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch target := r.Header.Get("X-Amz-Target"); target {
+		case "DynamoDB_20120810.PutItem":
+			items[req.Item["key"]["S"]] = req.Item
+			json.NewEncoder(w).Encode(map[string]any{})
+		case "DynamoDB_20120810.GetItem":
+			resp := map[string]any{}
+			if v, ok := items[req.Key["key"]["S"]]; ok {
+				resp["Item"] = v
+			}
+			json.NewEncoder(w).Encode(resp)
+		case "DynamoDB_20120810.UpdateItem":
+			key := req.Key["key"]["S"]
+			v, ok := items[key]
+			switch {
+			case req.UpdateExpression == "ADD #uses :minus_one":
+				uses, _ := strconv.ParseInt(v["uses"]["N"], 10, 64)
+				if !ok || uses <= 0 {
+					writeError("ConditionalCheckFailedException", "The conditional request failed")
+					return
+				}
+				v["uses"] = attributeValue{"N": strconv.FormatInt(uses-1, 10)}
+				json.NewEncoder(w).Encode(map[string]any{})
+			case strings.HasPrefix(req.UpdateExpression, "ADD #uses"):
+				if !ok {
+					v = item{"key": req.Key["key"], "expires_at": req.ExpressionAttributeValues[":expires_at"]}
+					items[key] = v
+				}
+				uses, _ := strconv.ParseInt(v["uses"]["N"], 10, 64)
+				v["uses"] = attributeValue{"N": strconv.FormatInt(uses+1, 10)}
+				json.NewEncoder(w).Encode(map[string]any{
+					"Attributes": item{"uses": v["uses"], "expires_at": v["expires_at"]},
+				})
+			case strings.HasPrefix(req.UpdateExpression, "SET #revoked_at"):
+				if !ok {
+					writeError("ConditionalCheckFailedException", "The conditional request failed")
+					return
+				}
+				v["revoked_at"] = req.ExpressionAttributeValues[":revoked_at"]
+				json.NewEncoder(w).Encode(map[string]any{})
+			default:
+				t.Errorf("unexpected update expression: %q", req.UpdateExpression)
+			}
+		default:
+			t.Errorf("unexpected target: %q", target)
+		}
+	}))
+	t.Cleanup(ts.Close)
+
+	return dynamodb.New(dynamodb.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(ts.URL),
+		HTTPClient:   ts.Client(),
+		Credentials: aws.CredentialsProviderFunc(func(ctx context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "SECRET"}, nil
+		}),
+		RetryMaxAttempts: 1,
+	})
+}
+
+func TestDynamoDBReplayStore(t *testing.T) {
+	svc := newDynamoDBStandIn(t, "github-app-token-replay")
+	s := &dynamoDBReplayStore{svc: svc, table: "github-app-token-replay"}
+	ctx := context.Background()
+	expiresAt := time.Now().Add(5 * time.Minute)
+
+	for want := int64(1); want <= 2; want++ {
+		got, err := s.use(ctx, "token-1", expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("want %d uses, got %d", want, got)
+		}
+	}
+	if got, err := s.use(ctx, "token-2", expiresAt); err != nil || got != 1 {
+		t.Errorf("want 1 use, got %d, %v", got, err)
+	}
+
+	// the refunded use can be used again.
+	if err := s.refund(ctx, "token-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.use(ctx, "token-1", expiresAt); err != nil || got != 2 {
+		t.Errorf("want 2 uses, got %d, %v", got, err)
+	}
+	if err := s.refund(ctx, "unknown-token"); err == nil {
+		t.Error("want error for the unknown token, but not")
+	}
+
+	s = &dynamoDBReplayStore{svc: svc, table: "unknown-table"}
+	if _, err := s.use(ctx, "token-1", expiresAt); err == nil {
+		t.Error("want error, but not")
+	}
+}
+
+func TestHandle_Replay(t *testing.T) {
+	var failing bool
+	newHandler := func(maxUses int64) *Handler {
+		return &Handler{
+			github: &githubClientMock{
+				ValidateAPIURLFunc: func(url string) error {
+					return nil
+				},
+				ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+					// the OIDC tokens in this test are the jti.
+					return &github.ActionsIDToken{
+						Claims: &jwt.Claims{
+							Issuer:         "https://token.actions.githubusercontent.com",
+							Audience:       []string{"https://github-app.shogo82148.com/1234567890"},
+							JWTID:          idToken,
+							ExpirationTime: time.Now().Add(5 * time.Minute),
+						},
+						Repository:        "shogo82148/actions-github-app-token",
+						RepositoryID:      "398574950",
+						RepositoryOwnerID: "1157344",
+					}, nil
+				},
+				GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+					return &github.GetRepoResponse{
+						ID:     398574950,
+						NodeID: "R_kgDOF8HFZg",
+					}, nil
+				},
+				GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+					return nil, &github.UnexpectedStatusCodeError{
+						StatusCode: http.StatusNotFound,
+					}
+				},
+				GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+					return &github.GetReposInstallationResponse{
+						ID: 641323,
+					}, nil
+				},
+				CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+					if failing && len(req.RepositoryIDs) > 0 {
+						return nil, &github.UnexpectedStatusCodeError{
+							StatusCode: http.StatusBadGateway,
+						}
+					}
+					return &github.CreateAppAccessTokenResponse{
+						Token: "ghs_dummyGitHubToken",
+					}, nil
+				},
+				RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+					return nil
+				},
+			},
+			appID:   1234567890,
+			replay:  newMemoryReplayStore(),
+			maxUses: maxUses,
+		}
+	}
+
+	h := newHandler(1)
+	if _, err := h.handle(context.Background(), "token-1", &requestBody{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := h.handle(context.Background(), "token-1", &requestBody{})
+	var forbidden *forbiddenError
+	if !errors.As(err, &forbidden) {
+		t.Errorf("want forbidden error, got %v", err)
+	}
+	if _, err := h.handle(context.Background(), "token-2", &requestBody{}); err != nil {
+		t.Errorf("a new token is rejected: %v", err)
+	}
+
+	// the dry runs don't use up the token.
+	h = newHandler(1)
+	if _, err := h.handle(context.Background(), "token-1", &requestBody{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.handle(context.Background(), "token-1", &requestBody{}); err != nil {
+		t.Errorf("the token is used up by the dry run: %v", err)
+	}
+
+	// the failure to issue the token doesn't use up the token, so the caller can retry.
+	h = newHandler(1)
+	failing = true
+	if _, err := h.handle(context.Background(), "token-1", &requestBody{}); err == nil {
+		t.Fatal("want error, but not")
+	}
+	failing = false
+	if _, err := h.handle(context.Background(), "token-1", &requestBody{}); err != nil {
+		t.Errorf("the token is used up by the failure: %v", err)
+	}
+
+	h = newHandler(2)
+	for range 2 {
+		if _, err := h.handle(context.Background(), "token-1", &requestBody{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := h.handle(context.Background(), "token-1", &requestBody{}); !errors.As(err, &forbidden) {
+		t.Errorf("want forbidden error, got %v", err)
+	}
+}
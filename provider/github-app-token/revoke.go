@@ -0,0 +1,356 @@
+package githubapptoken
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+)
+
+// issuedToken is the record of a token that the API issued.
+type issuedToken struct {
+	// Repository is the full name of the repository that requested the token.
+	Repository string
+
+	// RunID is the id of the workflow run that requested the token.
+	RunID string
+
+	// InstallationID is the installation of the app that the token belongs to.
+	InstallationID uint64
+
+	// ExpiresAt is when the token expires.
+	ExpiresAt time.Time
+
+	// RevokedAt is when the token was revoked. It is zero if the token is still valid.
+	RevokedAt time.Time
+}
+
+// tokenStore records the tokens that the API issued.
+// The tokens are identified by their hashes, so the store never holds the tokens themselves.
+type tokenStore interface {
+	// put records the issued token.
+	put(ctx context.Context, hash string, record *issuedToken) error
+
+	// get returns the record of the token. It returns nil if the token is unknown.
+	get(ctx context.Context, hash string) (*issuedToken, error)
+
+	// markRevoked records the revocation of the token.
+	markRevoked(ctx context.Context, hash string, at time.Time) error
+}
+
+// hashToken returns the key of the token in tokenStore.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// memoryTokenStore is a tokenStore in the memory.
+// The records are lost when the process exits, and are not shared between the instances of the API.
+type memoryTokenStore struct {
+	mu      sync.Mutex
+	records map[string]*issuedToken
+	now     func() time.Time
+}
+
+func newMemoryTokenStore() *memoryTokenStore {
+	return &memoryTokenStore{
+		records: make(map[string]*issuedToken),
+		now:     time.Now,
+	}
+}
+
+func (s *memoryTokenStore) put(ctx context.Context, hash string, record *issuedToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the expired tokens can't be revoked any more.
+	now := s.now()
+	for k, v := range s.records {
+		if !v.ExpiresAt.IsZero() && v.ExpiresAt.Before(now) {
+			delete(s.records, k)
+		}
+	}
+
+	r := *record
+	s.records[hash] = &r
+	return nil
+}
+
+func (s *memoryTokenStore) get(ctx context.Context, hash string) (*issuedToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[hash]
+	if !ok {
+		return nil, nil
+	}
+	ret := *r
+	return &ret, nil
+}
+
+func (s *memoryTokenStore) markRevoked(ctx context.Context, hash string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.records[hash]
+	if !ok {
+		return fmt.Errorf("the token is not found")
+	}
+	r.RevokedAt = at
+	return nil
+}
+
+// newTokenStore creates the tokenStore from the environment variable GITHUB_APP_TOKEN_TABLE,
+// the name of the DynamoDB table that records the issued tokens.
+// The default is the memory of each instance.
+func newTokenStore(cfg aws.Config) tokenStore {
+	if table := os.Getenv("GITHUB_APP_TOKEN_TABLE"); table != "" {
+		return &dynamoDBTokenStore{
+			svc:   dynamodb.NewFromConfig(cfg),
+			table: table,
+			now:   time.Now,
+		}
+	}
+	return newMemoryTokenStore()
+}
+
+// dynamoDBTokenStore is a tokenStore in a DynamoDB table, shared between the instances of the API.
+// The partition key of the table is "key" of the type String,
+// and the time to live of the table should be enabled on "expires_at".
+type dynamoDBTokenStore struct {
+	svc   dynamoDBService
+	table string
+	now   func() time.Time
+}
+
+// tokenTTL is how long the record of a token without the expiration is kept.
+// The installation tokens expire after an hour.
+const tokenTTL = time.Hour
+
+func (s *dynamoDBTokenStore) put(ctx context.Context, hash string, record *issuedToken) error {
+	expiresAt := record.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = s.now().Add(tokenTTL)
+	}
+	_, err := s.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"key":             &types.AttributeValueMemberS{Value: hash},
+			"repository":      &types.AttributeValueMemberS{Value: record.Repository},
+			"run_id":          &types.AttributeValueMemberS{Value: record.RunID},
+			"installation_id": &types.AttributeValueMemberN{Value: strconv.FormatUint(record.InstallationID, 10)},
+			"expires_at":      &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+	})
+	return err
+}
+
+func (s *dynamoDBTokenStore) get(ctx context.Context, hash string) (*issuedToken, error) {
+	out, err := s.svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: hash},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil {
+		return nil, nil
+	}
+
+	record := &issuedToken{}
+	if v, ok := out.Item["repository"].(*types.AttributeValueMemberS); ok {
+		record.Repository = v.Value
+	}
+	if v, ok := out.Item["run_id"].(*types.AttributeValueMemberS); ok {
+		record.RunID = v.Value
+	}
+	if v, ok := out.Item["installation_id"].(*types.AttributeValueMemberN); ok {
+		record.InstallationID, err = strconv.ParseUint(v.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid installation_id: %w", err)
+		}
+	}
+	if v, ok := out.Item["expires_at"].(*types.AttributeValueMemberN); ok {
+		sec, err := strconv.ParseInt(v.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expires_at: %w", err)
+		}
+		record.ExpiresAt = time.Unix(sec, 0)
+	}
+	if v, ok := out.Item["revoked_at"].(*types.AttributeValueMemberN); ok {
+		sec, err := strconv.ParseInt(v.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid revoked_at: %w", err)
+		}
+		record.RevokedAt = time.Unix(sec, 0)
+	}
+
+	// DynamoDB deletes the expired items lazily.
+	if record.ExpiresAt.Before(s.now()) {
+		return nil, nil
+	}
+	return record, nil
+}
+
+func (s *dynamoDBTokenStore) markRevoked(ctx context.Context, hash string, at time.Time) error {
+	_, err := s.svc.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: hash},
+		},
+		UpdateExpression:    aws.String("SET #revoked_at = :revoked_at"),
+		ConditionExpression: aws.String("attribute_exists(#key)"),
+		ExpressionAttributeNames: map[string]string{
+			"#key":        "key",
+			"#revoked_at": "revoked_at",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":revoked_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(at.Unix(), 10)},
+		},
+	})
+	var notFound *types.ConditionalCheckFailedException
+	if errors.As(err, &notFound) {
+		return fmt.Errorf("the token is not found")
+	}
+	return err
+}
+
+// recordTokens records the issued tokens, so that the workflow run can revoke them later.
+func (h *Handler) recordTokens(ctx context.Context, id *github.ActionsIDToken, tokens []*installationToken) {
+	if h.tokens == nil {
+		return
+	}
+	for _, t := range tokens {
+		err := h.tokens.put(ctx, hashToken(t.GitHubToken), &issuedToken{
+			Repository:     id.Repository,
+			RunID:          id.RunID,
+			InstallationID: t.InstallationID,
+			ExpiresAt:      t.ExpiresAt,
+		})
+		if err != nil {
+			// the token is still usable, only the revocation through the API fails.
+			slog.WarnContext(ctx, "failed to record the token", errAttr(err))
+		}
+	}
+}
+
+// revokeRequestBody is the request body for the revocation.
+type revokeRequestBody struct {
+	// APIURL is the url of GitHub API that issued the token.
+	// It is used only if several apps are behind the API.
+	APIURL string `json:"api_url"`
+
+	// GitHubToken is the token to revoke.
+	GitHubToken string `json:"github_token"`
+}
+
+// serveRevoke handles the revocation requests.
+// The Authorization header has the OIDC token of the workflow run that requested the token.
+func (h *Handler) serveRevoke(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	if r.Method != http.MethodPost {
+		h.handleMethodNotAllowed(w)
+		return
+	}
+
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		h.handleError(ctx, w, r, fmt.Errorf("failed to read the request body: %w", err))
+		return
+	}
+	var payload *revokeRequestBody
+	if err := json.Unmarshal(data, &payload); err != nil {
+		h.handleError(ctx, w, r, &validationError{
+			message: fmt.Sprintf("failed to unmarshal the request body: %v", err),
+		})
+		return
+	}
+	token, err := h.getAuthToken(r.Header)
+	if err != nil {
+		h.handleError(ctx, w, r, err)
+		return
+	}
+
+	resp, err := h.handleRevoke(ctx, token, payload)
+	if err != nil {
+		h.handleError(ctx, w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		slog.ErrorContext(ctx, "failed to write the response", errAttr(err))
+	}
+}
+
+func (h *Handler) handleRevoke(ctx context.Context, token string, req *revokeRequestBody) (*responseBody, error) {
+	if req == nil || req.GitHubToken == "" {
+		return nil, &validationError{
+			message: "github_token is required",
+		}
+	}
+	app, err := h.selectApp(token, req.APIURL)
+	if err != nil {
+		return nil, err
+	}
+	id, err := app.validateToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.tokens == nil {
+		return nil, &forbiddenError{err: errors.New("the revocation is not enabled")}
+	}
+	hash := hashToken(req.GitHubToken)
+	record, err := h.tokens.get(ctx, hash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the record of the token: %w", err)
+	}
+	if record == nil {
+		return nil, &forbiddenError{err: errors.New("the token is not issued by the API")}
+	}
+	if !strings.EqualFold(record.Repository, id.Repository) || record.RunID != id.RunID {
+		return nil, &forbiddenError{
+			err: fmt.Errorf("the token is issued for %s run %s, not for %s run %s", record.Repository, record.RunID, id.Repository, id.RunID),
+		}
+	}
+	if !record.RevokedAt.IsZero() {
+		return &responseBody{
+			Message: "the token is already revoked",
+		}, nil
+	}
+
+	if err := app.github.RevokeAppAccessToken(ctx, req.GitHubToken); err != nil {
+		// 401 means that the token is already invalid, revoked by someone else or expired.
+		if status, ok := githubStatusCode(err); !ok || status != http.StatusUnauthorized {
+			return nil, fmt.Errorf("failed to revoke the token: %w", err)
+		}
+	}
+	if err := h.tokens.markRevoked(ctx, hash, time.Now()); err != nil {
+		slog.WarnContext(ctx, "failed to record the revocation", errAttr(err))
+	}
+	slog.InfoContext(
+		ctx, "the token is revoked",
+		claimsAttr(id),
+		slog.Uint64("installation_id", record.InstallationID),
+	)
+	return &responseBody{
+		Message: "the token is revoked",
+	}, nil
+}
@@ -0,0 +1,233 @@
+package githubapptoken
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shogo82148/actions-github-app-token/provider/github-app-token/github"
+	"github.com/shogo82148/goat/jwt"
+)
+
+// newRevokeGitHubMock returns the GitHub client that issues "ghs_dummyGitHubToken",
+// and records the revoked tokens into revoked.
+func newRevokeGitHubMock(revoked *[]string) *githubClientMock {
+	return &githubClientMock{
+		ValidateAPIURLFunc: func(url string) error {
+			return nil
+		},
+		ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+			// the OIDC tokens in this test are the run ids.
+			return &github.ActionsIDToken{
+				Claims: &jwt.Claims{
+					Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+				},
+				Repository:        "shogo82148/actions-github-app-token",
+				RepositoryID:      "398574950",
+				RepositoryOwnerID: "1157344",
+				RunID:             idToken,
+			}, nil
+		},
+		GetRepoFunc: func(ctx context.Context, token, owner, repo string) (*github.GetRepoResponse, error) {
+			return &github.GetRepoResponse{
+				ID:     398574950,
+				NodeID: "R_kgDOF8HFZg",
+			}, nil
+		},
+		GetReposContentFunc: func(ctx context.Context, token, owner, repo, path string) (*github.GetReposContentResponse, error) {
+			return nil, &github.UnexpectedStatusCodeError{
+				StatusCode: http.StatusNotFound,
+			}
+		},
+		GetReposInstallationFunc: func(ctx context.Context, owner, repo string) (*github.GetReposInstallationResponse, error) {
+			return &github.GetReposInstallationResponse{
+				ID: 641323,
+			}, nil
+		},
+		CreateAppAccessTokenFunc: func(ctx context.Context, installationID uint64, req *github.CreateAppAccessTokenRequest) (*github.CreateAppAccessTokenResponse, error) {
+			if req.Permissions != nil && req.Permissions.SingleFile == "read" {
+				return &github.CreateAppAccessTokenResponse{
+					Token: "ghs_policyToken",
+				}, nil
+			}
+			return &github.CreateAppAccessTokenResponse{
+				Token:     "ghs_dummyGitHubToken",
+				ExpiresAt: time.Now().Add(time.Hour),
+			}, nil
+		},
+		RevokeAppAccessTokenFunc: func(ctx context.Context, token string) error {
+			*revoked = append(*revoked, token)
+			return nil
+		},
+	}
+}
+
+func TestHandleRevoke(t *testing.T) {
+	var revoked []string
+	h := &Handler{
+		github: newRevokeGitHubMock(&revoked),
+		appID:  1234567890,
+		tokens: newMemoryTokenStore(),
+	}
+	if _, err := h.handle(context.Background(), "1234", &requestBody{}); err != nil {
+		t.Fatal(err)
+	}
+	revoked = nil
+
+	// the token is unknown.
+	_, err := h.handleRevoke(context.Background(), "1234", &revokeRequestBody{GitHubToken: "ghs_unknown"})
+	var forbidden *forbiddenError
+	if !errors.As(err, &forbidden) {
+		t.Errorf("want forbidden error, got %v", err)
+	}
+
+	// another run can't revoke the token.
+	_, err = h.handleRevoke(context.Background(), "5678", &revokeRequestBody{GitHubToken: "ghs_dummyGitHubToken"})
+	if !errors.As(err, &forbidden) {
+		t.Errorf("want forbidden error, got %v", err)
+	}
+	if len(revoked) != 0 {
+		t.Errorf("unexpected revocation: %v", revoked)
+	}
+
+	resp, err := h.handleRevoke(context.Background(), "1234", &revokeRequestBody{GitHubToken: "ghs_dummyGitHubToken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Message != "the token is revoked" {
+		t.Errorf("unexpected message: %q", resp.Message)
+	}
+	if len(revoked) != 1 || revoked[0] != "ghs_dummyGitHubToken" {
+		t.Errorf("unexpected revocation: %v", revoked)
+	}
+
+	// the revocation is recorded.
+	record, err := h.tokens.get(context.Background(), hashToken("ghs_dummyGitHubToken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.RevokedAt.IsZero() {
+		t.Error("the revocation is not recorded")
+	}
+	resp, err = h.handleRevoke(context.Background(), "1234", &revokeRequestBody{GitHubToken: "ghs_dummyGitHubToken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Message != "the token is already revoked" || len(revoked) != 1 {
+		t.Errorf("unexpected response: %q, revoked %v", resp.Message, revoked)
+	}
+}
+
+func TestHandleRevoke_DynamoDB(t *testing.T) {
+	svc := newDynamoDBStandIn(t, "github-app-token-tokens")
+	var revoked []string
+	newHandler := func() *Handler {
+		return &Handler{
+			github: newRevokeGitHubMock(&revoked),
+			appID:  1234567890,
+			tokens: &dynamoDBTokenStore{svc: svc, table: "github-app-token-tokens", now: time.Now},
+		}
+	}
+
+	// another instance of the API revokes the token.
+	if _, err := newHandler().handle(context.Background(), "1234", &requestBody{}); err != nil {
+		t.Fatal(err)
+	}
+	revoked = nil
+	h := newHandler()
+	_, err := h.handleRevoke(context.Background(), "5678", &revokeRequestBody{GitHubToken: "ghs_dummyGitHubToken"})
+	var forbidden *forbiddenError
+	if !errors.As(err, &forbidden) {
+		t.Errorf("want forbidden error, got %v", err)
+	}
+	resp, err := h.handleRevoke(context.Background(), "1234", &revokeRequestBody{GitHubToken: "ghs_dummyGitHubToken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Message != "the token is revoked" || len(revoked) != 1 {
+		t.Errorf("unexpected response: %q, revoked %v", resp.Message, revoked)
+	}
+	resp, err = newHandler().handleRevoke(context.Background(), "1234", &revokeRequestBody{GitHubToken: "ghs_dummyGitHubToken"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Message != "the token is already revoked" || len(revoked) != 1 {
+		t.Errorf("unexpected response: %q, revoked %v", resp.Message, revoked)
+	}
+}
+
+func TestDynamoDBTokenStore(t *testing.T) {
+	svc := newDynamoDBStandIn(t, "github-app-token-tokens")
+	now := time.Now()
+	s := &dynamoDBTokenStore{svc: svc, table: "github-app-token-tokens", now: func() time.Time { return now }}
+	ctx := context.Background()
+
+	record := &issuedToken{
+		Repository:     "shogo82148/actions-github-app-token",
+		RunID:          "1234",
+		InstallationID: 641323,
+		ExpiresAt:      now.Add(time.Hour).Truncate(time.Second),
+	}
+	if err := s.put(ctx, "token-1", record); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.get(ctx, "token-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, record) {
+		t.Errorf("want %#v, got %#v", record, got)
+	}
+
+	if got, err := s.get(ctx, "token-2"); err != nil || got != nil {
+		t.Errorf("want nil, got %#v, %v", got, err)
+	}
+	if err := s.markRevoked(ctx, "token-2", now); err == nil {
+		t.Error("want error for the unknown token, but not")
+	}
+
+	// the expired records may remain in the table, but they are unknown.
+	now = now.Add(2 * time.Hour)
+	if got, err := s.get(ctx, "token-1"); err != nil || got != nil {
+		t.Errorf("want nil, got %#v, %v", got, err)
+	}
+}
+
+func TestServeRevoke(t *testing.T) {
+	h := &Handler{
+		github: &githubClientMock{
+			ParseIDTokenFunc: func(ctx context.Context, idToken string) (*github.ActionsIDToken, error) {
+				return &github.ActionsIDToken{
+					Claims: &jwt.Claims{
+						Audience: []string{"https://github-app.shogo82148.com/1234567890"},
+					},
+					Repository: "shogo82148/actions-github-app-token",
+					RunID:      "1234",
+				}, nil
+			},
+		},
+		appID:  1234567890,
+		tokens: newMemoryTokenStore(),
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/revoke", strings.NewReader(`{"github_token":"ghs_unknown"}`))
+	req.Header.Set("Authorization", "Bearer dummy-token")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("unexpected status: want %d, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/revoke", strings.NewReader(`{}`))
+	req.Header.Set("Authorization", "Bearer dummy-token")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status: want %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}